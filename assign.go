@@ -0,0 +1,122 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// With --assign=pull mappers pull chunks from inputChunks as they become free, which balances the
+// load but makes which mapper processes which chunk differ between runs. The round-robin and file
+// modes instead route chunk i to mapper i mod mappers, or every chunk of a file to the mapper
+// picked by a hash of its name, through a queue and a channel per mapper. Chunks reach a mapper in
+// the order they are sent on inputChunks, and a mapper that falls behind only holds up the others
+// once maxQueuedData chunks of stdin or input command data are queued for it. Chunks of input
+// files only hold their range and are queued without limit.
+const (
+	assignPull       = "pull"
+	assignRoundRobin = "round-robin"
+	assignFile       = "file"
+	defaultAssign    = assignPull
+)
+
+// maxQueuedData is the number of chunks holding data in memory that may be queued per mapper.
+const maxQueuedData = 2
+
+var (
+	// mapperChunks holds the chunks of every mapper with --assign=round-robin or file.
+	mapperChunks []chan *chunk
+
+	// queues are the chunks assigned to every mapper and not yet taken from mapperChunks, guarded
+	// by queueMu. queuedData counts the queued chunks holding data of every mapper and queuesClosed
+	// is set once all chunks have been queued.
+	queueMu      sync.Mutex
+	queueCond    = sync.NewCond(&queueMu)
+	queues       [][]*chunk
+	queuedData   []int
+	queuesClosed bool
+)
+
+// setupAssign creates the channel of every mapper unless chunks are pulled.
+func setupAssign() {
+	if assign == assignPull {
+		return
+	}
+	mapperChunks = make([]chan *chunk, mappers)
+	for i := range mapperChunks {
+		mapperChunks[i] = make(chan *chunk)
+	}
+	queues, queuedData, queuesClosed = make([][]*chunk, mappers), make([]int, mappers), false
+}
+
+// startAssign routes the chunks of inputChunks to the queues of the mappers, from which a
+// goroutine per mapper forwards them to its channel.
+func startAssign(chunks chan *chunk) {
+	for i := range mapperChunks {
+		go forwardChunks(i)
+	}
+	i := 0
+	for c := range chunks {
+		m := assignMapper(c, i, len(mapperChunks))
+		queueMu.Lock()
+		for c.data != nil && queuedData[m] >= maxQueuedData {
+			queueCond.Wait()
+		}
+		if c.data != nil {
+			queuedData[m]++
+		}
+		queues[m] = append(queues[m], c)
+		queueCond.Broadcast()
+		queueMu.Unlock()
+		i++
+	}
+	queueMu.Lock()
+	queuesClosed = true
+	queueCond.Broadcast()
+	queueMu.Unlock()
+}
+
+// forwardChunks sends the queued chunks of mapper i to its channel and closes the channel once all
+// chunks have been sent.
+func forwardChunks(i int) {
+	for {
+		queueMu.Lock()
+		for len(queues[i]) == 0 && !queuesClosed {
+			queueCond.Wait()
+		}
+		if len(queues[i]) == 0 {
+			queueMu.Unlock()
+			close(mapperChunks[i])
+			return
+		}
+		c := queues[i][0]
+		queues[i] = queues[i][1:]
+		if c.data != nil {
+			queuedData[i]--
+			queueCond.Broadcast()
+		}
+		queueMu.Unlock()
+		mapperChunks[i] <- c
+	}
+}
+
+// assignMapper returns the mapper of chunk c, the i-th chunk.
+func assignMapper(c *chunk, i, mappers int) int {
+	if assign != assignFile {
+		return i % mappers
+	}
+	name := c.filename
+	if c.files != nil {
+		name = c.files[0].name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(mappers))
+}
+
+// chunks returns the channel the mapper reads its chunks from.
+func (c context) chunks() chan *chunk {
+	if mapperChunks != nil {
+		return mapperChunks[c.workerID]
+	}
+	return inputChunks
+}
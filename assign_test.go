@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestAssignMapper(t *testing.T) {
+	defer func(a string) { assign = a }(assign)
+	chunks := []*chunk{
+		{filename: "a", end: 10},
+		{filename: "b", end: 10},
+		{filename: "a", start: 10, end: 20},
+		{files: []inputFile{{"b", 1}, {"c", 1}}, end: 2},
+		{filename: "c", end: 10},
+	}
+	assign = assignRoundRobin
+	for i, c := range chunks {
+		if m := assignMapper(c, i, 3); m != i%3 {
+			t.Errorf("assignMapper(%s, %d, 3) => %d, want %d", c.describe(), i, m, i%3)
+		}
+	}
+	assign = assignFile
+	if assignMapper(chunks[0], 0, 3) != assignMapper(chunks[2], 2, 3) {
+		t.Errorf("assignMapper assigned the chunks of file a to different mappers")
+	}
+	if assignMapper(chunks[1], 1, 3) != assignMapper(chunks[3], 3, 3) {
+		t.Errorf("assignMapper assigned a combined chunk starting with file b to a different mapper than b")
+	}
+}
+
+func TestStartAssign(t *testing.T) {
+	defer func(a string, m int) { assign, mappers = a, m }(assign, mappers)
+	assign, mappers = assignRoundRobin, 2
+	defer func() { mapperChunks = nil }()
+	for _, data := range []bool{false, true} {
+		setupAssign()
+		// every mapper gets as many chunks as it can take without reading any, one held by its
+		// forwarder and maxQueuedData queued, so startAssign must return without any reads
+		n := mappers * (maxQueuedData + 1)
+		chunks := make(chan *chunk, n)
+		for i := 0; i < n; i++ {
+			c := &chunk{filename: "a", start: int64(i), end: int64(i + 1)}
+			if data {
+				c.data = []byte{'a'}
+			}
+			chunks <- c
+		}
+		close(chunks)
+		startAssign(chunks)
+		for _, m := range []int{1, 0} {
+			for i := m; i < n; i += mappers {
+				if c := <-mapperChunks[m]; c.start != int64(i) {
+					t.Fatalf("data %v: mapper %d got chunk %d, want %d", data, m, c.start, i)
+				}
+			}
+			if _, ok := <-mapperChunks[m]; ok {
+				t.Errorf("data %v: mapper %d channel was not closed", data, m)
+			}
+		}
+	}
+}
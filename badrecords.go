@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// bad record actions
+const (
+	badRecordsFail       = "fail"
+	badRecordsSkip       = "skip"
+	badRecordsDeadLetter = "deadletter"
+)
+
+// badRecordPolicy decides what happens to mapper output lines that cannot be parsed, such as lines
+// with a non-numeric or out of range partition. Unless the action is fail, bad records are skipped
+// until more than maxCount records or, at the end of the map stage, more than maxRatio of all
+// mapper output records were bad. Negative maximums are not enforced.
+type badRecordPolicy struct {
+	action   string
+	maxCount int64
+	maxRatio float64
+}
+
+// parseBadRecords parses a bad record policy, an action optionally followed by a maximum count or
+// percentage of bad records, for example:
+//
+//	fail, skip, skip:100, deadletter:0.5%
+func parseBadRecords(v string) (badRecordPolicy, error) {
+	p := badRecordPolicy{maxCount: -1, maxRatio: -1}
+	kv := strings.SplitN(v, ":", 2)
+	p.action = kv[0]
+	switch p.action {
+	case badRecordsFail:
+		if len(kv) == 2 {
+			return p, fmt.Errorf("%s does not take a maximum", badRecordsFail)
+		}
+		return p, nil
+	case badRecordsSkip, badRecordsDeadLetter:
+	default:
+		return p, fmt.Errorf("unknown action '%s'", p.action)
+	}
+	if len(kv) == 1 {
+		return p, nil
+	}
+	if strings.HasSuffix(kv[1], "%") {
+		f, err := strconv.ParseFloat(strings.TrimSuffix(kv[1], "%"), 64)
+		if err != nil || f < 0 || 100 < f {
+			return p, fmt.Errorf("bad percentage %s", kv[1])
+		}
+		p.maxRatio = f / 100
+		return p, nil
+	}
+	n, err := strconv.ParseInt(kv[1], 10, 64)
+	if err != nil || n < 0 {
+		return p, fmt.Errorf("bad count %s", kv[1])
+	}
+	p.maxCount = n
+	return p, nil
+}
+
+// badRecordCount is the number of bad records found by all mappers so far.
+var badRecordCount int64
+
+// badRecordWriter handles the bad records of a mapper according to the policy. With the deadletter
+// action bad records are written together with the worker id and the reason to the file
+// _bad-records-<worker id> in the output directory, which is created when the first bad record is
+// found. The records in the file are delimited, or framed with --framed, like worker input.
+type badRecordWriter struct {
+	c context
+	f *os.File
+	w *bufio.Writer
+}
+
+// add handles the bad record line, an error is returned if the record fails the job.
+func (b *badRecordWriter) add(line []byte, reason error) error {
+	if badRecords.action == badRecordsFail {
+		return b.c.err(fmt.Sprintf("bad record %q - %v", line, reason))
+	}
+	atomic.AddInt64(&b.c.stats().BadRecords, 1)
+	n := atomic.AddInt64(&badRecordCount, 1)
+	if badRecords.maxCount >= 0 && n > badRecords.maxCount {
+		return b.c.err(fmt.Sprintf(
+			"more than %d bad records, the last was %q - %v", badRecords.maxCount, line, reason,
+		))
+	}
+	if badRecords.action != badRecordsDeadLetter {
+		return nil
+	}
+	if b.f == nil {
+		f, err := os.Create(path.Join(tempOutput, fmt.Sprintf("_bad-records-%d", b.c.workerID)))
+		if err != nil {
+			return b.c.err(fmt.Sprintf("failed creating dead-letter file - %v", err))
+		}
+		b.f, b.w = f, bufio.NewWriter(f)
+	}
+	fields := []string{
+		strconv.Itoa(b.c.workerID),
+		strings.Replace(reason.Error(), string(keyDelimiter), " ", -1),
+		string(line),
+	}
+	record := []byte(strings.Join(fields, string(keyDelimiter)))
+	if _, err := writeWorkerRecord(b.w, record); err != nil {
+		return b.c.err(fmt.Sprintf("failed writing dead-letter file - %v", err))
+	}
+	return nil
+}
+
+// close flushes and closes the dead-letter file if one was created.
+func (b *badRecordWriter) close() error {
+	if b.f == nil {
+		return nil
+	}
+	if err := b.w.Flush(); err != nil {
+		b.f.Close()
+		return b.c.err(fmt.Sprintf("failed writing dead-letter file - %v", err))
+	}
+	return b.f.Close()
+}
+
+// checkBadRecords enforces the maximum ratio of bad records once the map stage has finished.
+func checkBadRecords() error {
+	bad := atomic.LoadInt64(&badRecordCount)
+	if badRecords.maxRatio < 0 || bad == 0 {
+		return nil
+	}
+	total := bad + totalStats(mapStats).OutputRecords
+	if ratio := float64(bad) / float64(total); ratio > badRecords.maxRatio {
+		return fmt.Errorf(
+			"%d of %d mapper output records (%.2f%%) were bad, more than the maximum of %g%%",
+			bad, total, 100*ratio, 100*badRecords.maxRatio,
+		)
+	}
+	return nil
+}
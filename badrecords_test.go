@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBadRecords(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		out badRecordPolicy
+		err string
+	}{
+		// without a maximum no bad record fails the job unless the action is fail
+		{"fail", badRecordPolicy{badRecordsFail, -1, -1}, ""},
+		{"skip", badRecordPolicy{badRecordsSkip, -1, -1}, ""},
+		{"deadletter", badRecordPolicy{badRecordsDeadLetter, -1, -1}, ""},
+
+		// a maximum count, 0 fails on the first bad record but still writes it as dead letter
+		{"skip:100", badRecordPolicy{badRecordsSkip, 100, -1}, ""},
+		{"deadletter:0", badRecordPolicy{badRecordsDeadLetter, 0, -1}, ""},
+
+		// a maximum percentage becomes a ratio checked at the end of the map stage
+		{"deadletter:2.5%", badRecordPolicy{badRecordsDeadLetter, -1, 0.025}, ""},
+		{"skip:0%", badRecordPolicy{badRecordsSkip, -1, 0}, ""},
+		{"skip:100%", badRecordPolicy{badRecordsSkip, -1, 1}, ""},
+
+		{"", badRecordPolicy{}, "unknown action ''"},
+		{"drop", badRecordPolicy{}, "unknown action 'drop'"},
+		{"Skip", badRecordPolicy{}, "unknown action 'Skip'"},
+		{"fail:1", badRecordPolicy{}, "fail does not take a maximum"},
+		{"skip:", badRecordPolicy{}, "bad count "},
+		{"skip:-1", badRecordPolicy{}, "bad count -1"},
+		{"skip:1.5", badRecordPolicy{}, "bad count 1.5"},
+		{"skip:%", badRecordPolicy{}, "bad percentage %"},
+		{"skip:-1%", badRecordPolicy{}, "bad percentage -1%"},
+		{"skip:101%", badRecordPolicy{}, "bad percentage 101%"},
+	} {
+		p, err := parseBadRecords(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseBadRecords(%q) => %+v, %v, want error %q", tt.in, p, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || p != tt.out {
+			t.Errorf("parseBadRecords(%q) => %+v, %v, want %+v", tt.in, p, err, tt.out)
+		}
+	}
+}
+
+func TestCheckBadRecords(t *testing.T) {
+	defer func(p badRecordPolicy, s []workerStats) {
+		badRecords, mapStats, badRecordCount = p, s, 0
+	}(badRecords, mapStats)
+	for _, tt := range []struct {
+		policy string
+		bad    int64
+		good   []int64
+		err    string
+	}{
+		{"skip", 50, []int64{50}, ""},
+		{"skip:10%", 0, []int64{0}, ""},
+		// the ratio is of all mapper output records, good ones summed over all mappers
+		{"skip:10%", 10, []int64{40, 50}, ""},
+		{
+			"skip:10%", 11, []int64{40, 50},
+			"11 of 101 mapper output records (10.89%) were bad, more than the maximum of 10%",
+		},
+		{"skip:0%", 1, []int64{1000}, "more than the maximum of 0%"},
+		{"skip:100%", 5, []int64{0}, ""},
+		// a maximum count is enforced while adding bad records, not here
+		{"skip:1", 5, []int64{0}, ""},
+	} {
+		p, err := parseBadRecords(tt.policy)
+		if err != nil {
+			t.Fatalf("parseBadRecords(%q) => %v", tt.policy, err)
+		}
+		badRecords, badRecordCount = p, tt.bad
+		mapStats = make([]workerStats, len(tt.good))
+		for i, n := range tt.good {
+			mapStats[i].OutputRecords = n
+		}
+		err = checkBadRecords()
+		if tt.err == "" && err == nil || err != nil && tt.err != "" && strings.Contains(err.Error(), tt.err) {
+			continue
+		}
+		t.Errorf(
+			"checkBadRecords() with %s, %d bad and %v good => %v, want %q",
+			tt.policy, tt.bad, tt.good, err, tt.err,
+		)
+	}
+}
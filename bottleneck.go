@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// pipeStats describe how the time of the stdin and stdout handlers of a worker was spent, in
+// seconds. Time blocked writing stdin or reading stdout is time xrt waited on the worker process,
+// the remainder of the active time of a handler is time the worker waited on xrt.
+type pipeStats struct {
+	StdinActive   float64 `json:"stdin_active"`
+	StdinBlocked  float64 `json:"stdin_blocked"`
+	StdoutActive  float64 `json:"stdout_active"`
+	StdoutBlocked float64 `json:"stdout_blocked"`
+}
+
+// recordPipes stores the pipe timings of a worker once its handlers have returned.
+func (c context) recordPipes(stdin, stdout *stream, stdinActive, stdoutActive time.Duration) {
+	p := pipeStats{
+		StdinActive:   stdinActive.Seconds(),
+		StdinBlocked:  time.Duration(atomic.LoadInt64(&stdin.blocked)).Seconds(),
+		StdoutActive:  stdoutActive.Seconds(),
+		StdoutBlocked: time.Duration(atomic.LoadInt64(&stdout.blocked)).Seconds(),
+	}
+	statsMu.Lock()
+	c.stats().Pipes = p
+	statsMu.Unlock()
+}
+
+// bottleneck is the verdict of the pipe analysis of a stage.
+type bottleneck struct {
+	Side       string    `json:"side"`
+	Suggestion string    `json:"suggestion"`
+	Pipes      pipeStats `json:"pipes"`
+}
+
+// analyzeBottleneck decides which side of the pipes limited a stage. If xrt spent more time
+// consuming the worker output than waiting for it, the worker was blocked on xrt handling its
+// output. Otherwise, if xrt spent more time producing the worker input than waiting for the
+// worker to accept it, the worker was starved of input. If neither is the case xrt was mostly
+// waiting on the worker process itself.
+func analyzeBottleneck(stage string, stats []workerStats) bottleneck {
+	t := pipeStats{}
+	spills := int64(0)
+	for i := range stats {
+		p := stats[i].Pipes
+		t.StdinActive += p.StdinActive
+		t.StdinBlocked += p.StdinBlocked
+		t.StdoutActive += p.StdoutActive
+		t.StdoutBlocked += p.StdoutBlocked
+		for j := range stats[i].Partitions {
+			spills += atomic.LoadInt64(&stats[i].Partitions[j].Spills)
+		}
+	}
+	worker := "mapper"
+	more := fmt.Sprintf("--%s", argMappers)
+	if stage == stageReduce {
+		worker = "reducer"
+		more = fmt.Sprintf("--%s", argReducers)
+	}
+	b := bottleneck{Pipes: t}
+	switch {
+	case t.StdoutActive-t.StdoutBlocked > t.StdoutBlocked:
+		if stage == stageMap && hasReducer() {
+			b.Side = "xrt partitioning and buffering mapper output"
+			if spills > 0 {
+				b.Suggestion = fmt.Sprintf("increase --%s to reduce spilling", argMemoryString)
+			} else {
+				b.Suggestion = fmt.Sprintf("increase %s to partition in parallel", more)
+			}
+		} else {
+			b.Side = fmt.Sprintf("xrt writing %s output", worker)
+			b.Suggestion = fmt.Sprintf("use faster storage for --%s or --%s", argOutput, argTempDir)
+		}
+	case t.StdinActive-t.StdinBlocked > t.StdinBlocked:
+		if stage == stageMap {
+			b.Side = "xrt reading input"
+			b.Suggestion = fmt.Sprintf("use faster storage for --%s or increase %s", argInput, more)
+		} else {
+			b.Side = "xrt merging buffers and spills"
+			b.Suggestion = fmt.Sprintf("increase --%s to reduce spilling or increase %s", argMemoryString, more)
+		}
+	default:
+		b.Side = fmt.Sprintf("%s process", worker)
+		b.Suggestion = fmt.Sprintf("increase %s if cores are available or speed up the %s", more, worker)
+	}
+	return b
+}
+
+// logBottleneck logs the bottleneck analysis of a stage.
+func logBottleneck(stage string, stats []workerStats) {
+	b := analyzeBottleneck(stage, stats)
+	infof("bottleneck", "  %s bottleneck: %s - %s", stage, b.Side, b.Suggestion)
+	infof(
+		"bottleneck",
+		"    blocked writing stdin %s of %s, blocked reading stdout %s of %s",
+		seconds(b.Pipes.StdinBlocked),
+		seconds(b.Pipes.StdinActive),
+		seconds(b.Pipes.StdoutBlocked),
+		seconds(b.Pipes.StdoutActive),
+	)
+}
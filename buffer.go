@@ -3,58 +3,101 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"sort"
+	"sync/atomic"
 )
 
+// minBufMem is the smallest buffer accepted, it holds a few small records so that spills are not
+// written for every record.
+const minBufMem = 256
+
 // buffer ...
 type buffer struct {
+	// fill is first so that it is 64-bit aligned for atomic access on 32-bit platforms.
+	fill int64
+
 	head     int
 	tail     int
 	buf      []byte
 	spills   int
 	spillDir string
+
+	// header is the layout of the record headers currently in the buffer and hdr its size. When
+	// auto is set the layout is re-evaluated from records and bytes every time the buffer is
+	// emptied by a spill.
+	header  headerLayout
+	hdr     int
+	auto    bool
+	records int
+	bytes   int
+	scratch []byte
+
+	stats *partitionStats
+	state *int32
+
+	// mapper and reducer identify the buffer in traces.
+	mapper  int
+	reducer int
 }
 
 // Len ...
 func (b *buffer) Len() int {
-	return b.head / 32
+	return b.head / b.hdr
 }
 
 // Swap ...
 func (b *buffer) Swap(i, j int) {
-	swap(b.buf, i, j)
+	if b.header == wideLayout {
+		swap(b.buf, i, j)
+		return
+	}
+	b.swapCompact(i, j)
 }
 
 // Less ...
 func (b *buffer) Less(i, j int) bool {
-	return compare(b.buf, i, j) < 0
+	if b.header == wideLayout {
+		return compare(b.buf, i, j) < 0
+	}
+	return b.compareCompact(i, j) < 0
 }
 
 // add ...
 func (b *buffer) add(record []byte) error {
-	recordSize := 16 + len(record)
-	if recordSize < 32 {
-		recordSize = 32
-	}
+	recordSize := b.recordSize(record)
 	if b.free() < recordSize {
 		if len(b.buf) < recordSize {
-			return fmt.Errorf(
-				"record is too large to fit in memory - required: %db but "+
-					"buffer memory can only hold %db",
-				recordSize,
-				len(b.buf),
-			)
+			return b.spillRecord(record)
 		}
 		if err := b.spill(); err != nil {
 			return err
 		}
 	}
 	b.appendRecord(record)
+	b.records++
+	b.bytes += len(record)
+	atomic.StoreInt64(&b.fill, int64(b.head+len(b.buf)-b.tail))
 	return nil
 }
 
+// recordSize returns the bytes record takes up in the buffer, including its header.
+func (b *buffer) recordSize(record []byte) int {
+	size := b.hdr
+	if len(record) > b.header.prefix {
+		size += len(record) - b.header.prefix
+	}
+	return size
+}
+
+// spillsOn reports whether adding record writes a spill file, either of the full buffer or of the
+// record itself.
+func (b *buffer) spillsOn(record []byte) bool {
+	return b.free() < b.recordSize(record)
+}
+
 // sort ...
 func (b *buffer) sort() {
 	sort.Sort(b)
@@ -62,12 +105,58 @@ func (b *buffer) sort() {
 
 // spill ...
 func (b *buffer) spill() error {
+	if b.state != nil {
+		atomic.StoreInt32(b.state, stateSpilling)
+		defer atomic.StoreInt32(b.state, stateRunning)
+	}
+	defer traceSpan(stageMap, b.mapper, "spill", map[string]interface{}{
+		"reducer": b.reducer,
+		"records": b.Len(),
+	})()
 	defer func() {
 		b.head = 0
 		b.tail = len(b.buf)
 		b.spills++
+		atomic.StoreInt64(&b.fill, 0)
+		if b.auto {
+			b.setHeader(autoLayout(len(b.buf), b.records, b.bytes))
+		}
 	}()
 	b.sort()
+	return b.writeSpill(func(wb *bufio.Writer) error {
+		s := newMemoryScanner(b)
+		for s.next() {
+			if err := writeRecord(wb, s.lastRecord(), s.nextRecord()); err != nil {
+				return err
+			}
+		}
+		return s.err()
+	})
+}
+
+// spillRecord writes a record that is too large for the buffer to disk as a sorted run of its own,
+// which is merged with the spills of the buffer. Only records larger than the total memory budget,
+// which could not be merged in memory, fail.
+func (b *buffer) spillRecord(record []byte) error {
+	if len(record) > memory {
+		return fmt.Errorf(
+			"record is too large to fit in memory - required: %db but memory can only hold %db",
+			len(record),
+			memory,
+		)
+	}
+	defer traceSpan(stageMap, b.mapper, "spill record", map[string]interface{}{
+		"reducer": b.reducer,
+		"bytes":   len(record),
+	})()
+	defer func() { b.spills++ }()
+	return b.writeSpill(func(wb *bufio.Writer) error {
+		return writeRecord(wb, nil, record)
+	})
+}
+
+// writeSpill creates the next spill file of the buffer and writes a sorted run to it with write.
+func (b *buffer) writeSpill(write func(*bufio.Writer) error) error {
 	if err := os.MkdirAll(b.spillDir, 0700); err != nil {
 		return err
 	}
@@ -77,18 +166,18 @@ func (b *buffer) spill() error {
 		return err
 	}
 	wb := bufio.NewWriter(w)
-	s := newMemoryScanner(b)
-	for s.next() {
-		if err := writeRecord(wb, s.lastRecord(), s.nextRecord()); err != nil {
-			return err
-		}
-	}
-	if err := s.err(); err != nil {
+	if err := write(wb); err != nil {
+		w.Close()
 		return err
 	}
 	if err := wb.Flush(); err != nil {
+		w.Close()
 		return err
 	}
+	if n, err := w.Seek(0, io.SeekCurrent); err == nil {
+		atomic.AddInt64(&b.stats.SpillBytes, n)
+	}
+	atomic.AddInt64(&b.stats.Spills, 1)
 	return w.Close()
 }
 
@@ -102,6 +191,11 @@ func (b *buffer) externalSort() error {
 		ways = 16
 	}
 	for b.spills > 1 {
+		atomic.AddInt64(&b.stats.MergePasses, 1)
+		endTrace := traceSpan(stageMap, b.mapper, "merge pass", map[string]interface{}{
+			"reducer": b.reducer,
+			"runs":    b.spills,
+		})
 		newSpills := 0
 		for i := 0; i <= b.spills/ways; i++ {
 			start := i * ways
@@ -154,6 +248,7 @@ func (b *buffer) externalSort() error {
 			}
 		}
 		b.spills = newSpills
+		endTrace()
 	}
 	return nil
 }
@@ -164,31 +259,68 @@ func (b *buffer) free() int {
 }
 
 func (b *buffer) appendRecord(record []byte) {
-	writeInt(b.buf, b.head, len(record))
-	b.head += 8
-	n := 16
-	if len(record) < 16 {
+	w, p := b.header.width, b.header.prefix
+	b.putInt(b.head, len(record))
+	b.head += w
+	n := p
+	if len(record) < p {
 		n = len(record)
 	}
 	copy(b.buf[b.head:b.head+n], record[0:n])
-	b.head += 16
-	if len(record) > 16 {
-		b.tail = b.tail - len(record) + 16
-		copy(b.buf[b.tail:b.tail+len(record)-16], record[16:len(record)])
-		writeInt(b.buf, b.head, b.tail)
+	b.head += p
+	if len(record) > p {
+		b.tail = b.tail - len(record) + p
+		copy(b.buf[b.tail:b.tail+len(record)-p], record[p:len(record)])
 	}
-	b.head += 8
+	b.putInt(b.head, b.tail)
+	b.head += w
 }
 
-// newBuffer ...
-func newBuffer(bufMem int, spillDir string) *buffer {
-	return &buffer{
+// record copies record i into dst, growing dst if it is too small, and returns the result.
+func (b *buffer) record(i int, dst []byte) []byte {
+	w, p := b.header.width, b.header.prefix
+	h := i * b.hdr
+	n := b.getInt(h)
+	if n > cap(dst) {
+		dst = make([]byte, 4096*(n/4096)+4096)
+	}
+	dst = dst[:n]
+	pn := p
+	if n < pn {
+		pn = n
+	}
+	copy(dst[0:pn], b.buf[h+w:h+w+pn])
+	if n > p {
+		t := b.getInt(h + w + p)
+		copy(dst[p:n], b.buf[t:t+n-p])
+	}
+	return dst
+}
+
+// setHeader switches the buffer to a new header layout. It may only be called on an empty buffer.
+func (b *buffer) setHeader(l headerLayout) {
+	b.header = l
+	b.hdr = l.size()
+	b.scratch = make([]byte, b.hdr)
+}
+
+// newBuffer creates a buffer of bufMem bytes using the header layout l, the zero headerLayout
+// selects the layout automatically.
+func newBuffer(bufMem int, spillDir string, l headerLayout) *buffer {
+	b := &buffer{
 		head:     0,
 		tail:     bufMem,
 		buf:      make([]byte, bufMem),
 		spills:   0,
 		spillDir: spillDir,
+		stats:    &partitionStats{},
+	}
+	if l == (headerLayout{}) {
+		b.auto = true
+		l = autoLayout(bufMem, 0, 0)
 	}
+	b.setHeader(l)
+	return b
 }
 
 func writeRecord(w *bufio.Writer, lst, nxt []byte) error {
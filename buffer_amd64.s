@@ -21,8 +21,8 @@ TEXT ·writeInt(SB), NOSPLIT, $0-40
 // func swap(b []byte, i int, j int)
 TEXT ·swap(SB), NOSPLIT, $0-40
 	MOVQ	b+0(FP), AX	// move starting address of b into AX
-	MOVQ	b+24(FP), SI	// move record index i into SI
-	MOVQ	b+32(FP), DI	// move record index j into DI
+	MOVQ	i+24(FP), SI	// move record index i into SI
+	MOVQ	j+32(FP), DI	// move record index j into DI
 	SHLQ	$5, SI		// SI = SI*32; since record header is 32 bytes
 	SHLQ	$5, DI		// DI = DI*32; since record header is 32 bytes
 	ADDQ	AX, SI		// SI = SI+AX; SI is now starting address of i in b
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	headerAuto    = "auto"
+	headerCompact = "compact"
+	headerWide    = "wide"
+
+	// minAutoPrefix and maxAutoPrefix bound the inline prefix width picked for compact headers
+	// when the layout is selected automatically.
+	minAutoPrefix = 4
+	maxAutoPrefix = 16
+
+	// maxPrefix is the widest inline prefix accepted for compact headers.
+	maxPrefix = 64
+)
+
+// headerLayout describes the fixed size record headers stored at the front of a buffer. Each
+// header holds the record length, an inline prefix of the record and the offset of the remainder
+// of the record, which is stored at the tail of the buffer.
+//
+//	+--------+----------------+--------+
+//	| length | prefix         | offset |
+//	+--------+----------------+--------+
+//	  width    prefix           width
+//
+// The wide layout (8 byte length and offset, 16 byte prefix) is sorted by the assembly
+// implementation of compare and swap. Compact layouts use 4 byte lengths and offsets with a
+// configurable prefix and trade some sort speed for a much smaller per-record overhead.
+type headerLayout struct {
+	width  int
+	prefix int
+}
+
+var wideLayout = headerLayout{width: 8, prefix: 16}
+
+func compactLayout(prefix int) headerLayout {
+	return headerLayout{width: 4, prefix: prefix}
+}
+
+// size returns the total number of bytes used by a single record header.
+func (l headerLayout) size() int {
+	return 2*l.width + l.prefix
+}
+
+func (l headerLayout) String() string {
+	if l == wideLayout {
+		return headerWide
+	}
+	return fmt.Sprintf("%s (%d byte prefix)", headerCompact, l.prefix)
+}
+
+// autoLayout picks a header layout for a buffer of bufMem bytes given the number of records and
+// record bytes added to it so far. Compact headers are used whenever the buffer is addressable by
+// 4 byte offsets, with a prefix sized to the average record so that small records are stored
+// entirely inline.
+func autoLayout(bufMem, records, size int) headerLayout {
+	if uint64(bufMem) > math.MaxUint32 {
+		return wideLayout
+	}
+	if records == 0 {
+		return compactLayout(defaultPrefix)
+	}
+	prefix := (size/records + 3) &^ 3
+	if prefix < minAutoPrefix {
+		prefix = minAutoPrefix
+	}
+	if prefix > maxAutoPrefix {
+		prefix = maxAutoPrefix
+	}
+	return compactLayout(prefix)
+}
+
+// getInt reads a length or offset stored in a record header at index i.
+func (b *buffer) getInt(i int) int {
+	if b.header.width == 8 {
+		return readInt(b.buf, i)
+	}
+	return int(binary.LittleEndian.Uint32(b.buf[i:]))
+}
+
+// putInt writes a length or offset into a record header at index i.
+func (b *buffer) putInt(i, n int) {
+	if b.header.width == 8 {
+		writeInt(b.buf, i, n)
+		return
+	}
+	binary.LittleEndian.PutUint32(b.buf[i:], uint32(n))
+}
+
+// compareCompact is the compact layout equivalent of compare.
+func (b *buffer) compareCompact(i, j int) int {
+	w, p := b.header.width, b.header.prefix
+	hi, hj := i*b.hdr, j*b.hdr
+	si := int(binary.LittleEndian.Uint32(b.buf[hi:]))
+	sj := int(binary.LittleEndian.Uint32(b.buf[hj:]))
+	spi, spj := si, sj
+	if spi > p {
+		spi = p
+	}
+	if spj > p {
+		spj = p
+	}
+	n := bytes.Compare(b.buf[hi+w:hi+w+spi], b.buf[hj+w:hj+w+spj])
+	if n == 0 && (si > p || sj > p) {
+		pi := int(binary.LittleEndian.Uint32(b.buf[hi+w+p:]))
+		pj := int(binary.LittleEndian.Uint32(b.buf[hj+w+p:]))
+		n = bytes.Compare(b.buf[pi:pi+si-spi], b.buf[pj:pj+sj-spj])
+	}
+	return n
+}
+
+// swapCompact is the compact layout equivalent of swap.
+func (b *buffer) swapCompact(i, j int) {
+	bi := b.buf[i*b.hdr : i*b.hdr+b.hdr]
+	bj := b.buf[j*b.hdr : j*b.hdr+b.hdr]
+	copy(b.scratch, bi)
+	copy(bi, bj)
+	copy(bj, b.scratch)
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 )
 
@@ -34,12 +37,17 @@ func generateRecords(prefixSize int) [][]byte {
 	return records
 }
 
-func TestCompare(t *testing.T) {
-	b := newBuffer(testBufferSize, ".")
+func generateTestRecords() [][]byte {
 	records := generateRecords(0)                      // 0-8 bytes
 	records = append(records, generateRecords(12)...)  // 12-20 bytes
 	records = append(records, generateRecords(28)...)  // 28-36 bytes
 	records = append(records, generateRecords(500)...) // 500+ bytes
+	return records
+}
+
+func TestCompare(t *testing.T) {
+	b := newBuffer(testBufferSize, ".", wideLayout)
+	records := generateTestRecords()
 	for _, record := range records {
 		b.appendRecord(record)
 	}
@@ -53,3 +61,66 @@ func TestCompare(t *testing.T) {
 		}
 	}
 }
+
+func TestCompareCompact(t *testing.T) {
+	for _, prefix := range []int{0, 4, 6, 8, 16} {
+		b := newBuffer(testBufferSize, ".", compactLayout(prefix))
+		records := generateTestRecords()
+		for _, record := range records {
+			b.appendRecord(record)
+		}
+		for i := range records {
+			for j := range records {
+				expected := bytes.Compare(records[i], records[j])
+				actual := b.compareCompact(i, j)
+				if expected != actual {
+					t.Errorf("compareCompact(%d=(%s), %d=(%s)) with %d byte prefix returned %d, want %d", i, records[i], j, records[j], prefix, actual, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	for _, l := range []headerLayout{wideLayout, compactLayout(0), compactLayout(8)} {
+		b := newBuffer(testBufferSize, ".", l)
+		records := generateTestRecords()
+		for _, record := range records {
+			b.appendRecord(record)
+		}
+		var dst []byte
+		for i, record := range records {
+			dst = b.record(i, dst)
+			if !bytes.Equal(dst, record) {
+				t.Errorf("record(%d) with %s headers returned (%s), want (%s)", i, l, dst, record)
+			}
+		}
+	}
+}
+
+func TestSpillRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xrt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(m int) { memory = m }(memory)
+	memory = 4096
+	b := newBuffer(256, dir, wideLayout)
+	small, large := []byte("b"), bytes.Repeat([]byte("a"), 1024)
+	for _, record := range [][]byte{small, large, small} {
+		if err := b.add(record); err != nil {
+			t.Fatalf("add(%d bytes) returned error %v, want no error", len(record), err)
+		}
+	}
+	if b.spills != 1 || b.Len() != 2 {
+		t.Fatalf("buffer has %d spills and %d records, want 1 spill and 2 records", b.spills, b.Len())
+	}
+	s := newFileScanner(path.Join(dir, "spill-0"))
+	if !s.next() || !bytes.Equal(s.nextRecord(), large) || s.next() || s.err() != nil {
+		t.Errorf("spill-0 does not hold exactly the large record")
+	}
+	if err := b.add(bytes.Repeat([]byte("a"), memory+1)); err == nil {
+		t.Errorf("add of a record larger than memory returned no error")
+	}
+}
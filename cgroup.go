@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cgroupUsage is the resource usage read from a cgroup, values that could not be read are -1.
+type cgroupUsage struct {
+	cpu        time.Duration
+	memoryPeak int
+}
+
+func (u cgroupUsage) String() string {
+	cpu, mem := "n/a", "n/a"
+	if u.cpu >= 0 {
+		cpu = u.cpu.String()
+	}
+	if u.memoryPeak >= 0 {
+		mem = formatMemory(u.memoryPeak)
+	}
+	return fmt.Sprintf("cpu: %s, peak memory: %s", cpu, mem)
+}
+
+type workerCgroupUsage struct {
+	stage    string
+	workerID int
+	usage    cgroupUsage
+}
+
+var (
+	// jobCgroup is the cgroup v2 subtree created for the job, it contains one leaf for xrt itself
+	// and one leaf per mapper and reducer.
+	jobCgroup string
+
+	cgroupUsageMu sync.Mutex
+	workerUsages  []workerCgroupUsage
+)
+
+// recordCgroupUsage stores the cgroup usage of a finished worker for the job summary.
+func recordCgroupUsage(c context, usage cgroupUsage) {
+	cgroupUsageMu.Lock()
+	defer cgroupUsageMu.Unlock()
+	workerUsages = append(workerUsages, workerCgroupUsage{c.stage, c.workerID, usage})
+}
+
+// logCgroupUsage logs the cgroup usage of the job and of every worker.
+func logCgroupUsage() {
+	cgroupUsageMu.Lock()
+	defer cgroupUsageMu.Unlock()
+	sort.Slice(workerUsages, func(i, j int) bool {
+		if workerUsages[i].stage != workerUsages[j].stage {
+			return workerUsages[i].stage == stageMap
+		}
+		return workerUsages[i].workerID < workerUsages[j].workerID
+	})
+	infof("usage", "  job cgroup usage: %s", jobCgroupUsage())
+	for _, u := range workerUsages {
+		infof("usage", "    %s.%d: %s", u.stage, u.workerID, u.usage)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroupPeriod is the cpu.max period used when enforcing the job cpu budget.
+const cgroupPeriod = 100000
+
+// originalCgroup is the cgroup xrt was started in, xrt moves itself back there on cleanup so that
+// the job cgroup can be removed.
+var originalCgroup string
+
+// setupCgroup creates the job cgroup under parent, applies the memory and cpu budgets and moves xrt
+// itself into the job cgroup so that its buffers are accounted for in the budget.
+func setupCgroup(parent string, memoryMax int, cpus float64) (err error) {
+	if originalCgroup, err = currentCgroup(); err != nil {
+		return err
+	}
+	controllers := []string{}
+	if memoryMax > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if cpus > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if err := enableControllers(parent, controllers); err != nil {
+		return err
+	}
+	jobCgroup = path.Join(parent, fmt.Sprintf("xrt-%d", os.Getpid()))
+	if err := os.Mkdir(jobCgroup, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(jobCgroup)
+			jobCgroup = ""
+		}
+	}()
+	if memoryMax > 0 {
+		if err := writeCgroupFile(jobCgroup, "memory.max", strconv.Itoa(memoryMax)); err != nil {
+			return err
+		}
+	}
+	if cpus > 0 {
+		quota := fmt.Sprintf("%d %d", int(cpus*cgroupPeriod), cgroupPeriod)
+		if err := writeCgroupFile(jobCgroup, "cpu.max", quota); err != nil {
+			return err
+		}
+	}
+	if err := enableControllers(jobCgroup, controllers); err != nil {
+		return err
+	}
+	self := path.Join(jobCgroup, "xrt")
+	if err := os.Mkdir(self, 0755); err != nil {
+		return err
+	}
+	if err := writeCgroupFile(self, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		os.Remove(self)
+		return err
+	}
+	return nil
+}
+
+// cleanupCgroup moves xrt back to its original cgroup and removes the job cgroup.
+func cleanupCgroup() error {
+	if jobCgroup == "" {
+		return nil
+	}
+	if err := writeCgroupFile(originalCgroup, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(jobCgroup)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			if err := os.Remove(path.Join(jobCgroup, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(jobCgroup)
+}
+
+// workerCgroup is the leaf cgroup of a single mapper or reducer.
+type workerCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// newWorkerCgroup creates the leaf cgroup name in the job cgroup.
+func newWorkerCgroup(name string) (*workerCgroup, error) {
+	p := path.Join(jobCgroup, name)
+	if err := os.Mkdir(p, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(p)
+	if err != nil {
+		os.Remove(p)
+		return nil, err
+	}
+	return &workerCgroup{p, dir}, nil
+}
+
+// attach makes the process started with attr begin its life in the worker cgroup.
+func (w *workerCgroup) attach(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(w.dir.Fd())
+}
+
+// release reads the resource usage of the worker cgroup and removes it. It must only be called
+// once the worker has exited.
+func (w *workerCgroup) release() (cgroupUsage, error) {
+	usage := readCgroupUsage(w.path)
+	if err := w.dir.Close(); err != nil {
+		return usage, err
+	}
+	return usage, os.Remove(w.path)
+}
+
+// jobCgroupUsage returns the resource usage of the whole job, including xrt itself.
+func jobCgroupUsage() cgroupUsage {
+	return readCgroupUsage(jobCgroup)
+}
+
+// readCgroupUsage reads the cpu time and peak memory of a cgroup, usage that cannot be read (for
+// example memory.peak on older kernels) is reported as -1.
+func readCgroupUsage(cgroup string) cgroupUsage {
+	usage := cgroupUsage{cpu: -1, memoryPeak: -1}
+	if b, err := ioutil.ReadFile(path.Join(cgroup, "cpu.stat")); err == nil {
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 2 && fields[0] == "usage_usec" {
+				if n, err := strconv.Atoi(fields[1]); err == nil {
+					usage.cpu = time.Duration(n) * time.Microsecond
+				}
+			}
+		}
+	}
+	if b, err := ioutil.ReadFile(path.Join(cgroup, "memory.peak")); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			usage.memoryPeak = n
+		}
+	}
+	return usage
+}
+
+// currentCgroup returns the cgroup v2 directory xrt is running in.
+func currentCgroup() (string, error) {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return path.Join(cgroupRoot(), line[3:]), nil
+		}
+	}
+	return "", fmt.Errorf("xrt is not running in a cgroup v2 hierarchy")
+}
+
+// cgroupRoot returns the mount point of the cgroup v2 hierarchy, which is /sys/fs/cgroup unless
+// the system uses the hybrid layout.
+func cgroupRoot() string {
+	if _, err := os.Stat("/sys/fs/cgroup/unified/cgroup.procs"); err == nil {
+		return "/sys/fs/cgroup/unified"
+	}
+	return "/sys/fs/cgroup"
+}
+
+// enableControllers enables the given controllers for the children of cgroup.
+func enableControllers(cgroup string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path.Join(cgroup, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	available := strings.Fields(string(b))
+	enable := []string{}
+	for _, c := range controllers {
+		found := false
+		for _, a := range available {
+			found = found || a == c
+		}
+		if !found {
+			return fmt.Errorf("the %s controller is not available in cgroup %s", c, cgroup)
+		}
+		enable = append(enable, "+"+c)
+	}
+	return writeCgroupFile(cgroup, "cgroup.subtree_control", strings.Join(enable, " "))
+}
+
+func writeCgroupFile(cgroup, name, value string) error {
+	filename := path.Join(cgroup, name)
+	if err := ioutil.WriteFile(filename, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed writing '%s' to %s - %v", value, filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setupCgroup(parent string, memoryMax int, cpus float64) error {
+	return errors.New("cgroups are only supported on linux")
+}
+
+func cleanupCgroup() error {
+	return nil
+}
+
+type workerCgroup struct{}
+
+func newWorkerCgroup(name string) (*workerCgroup, error) {
+	return nil, errors.New("cgroups are only supported on linux")
+}
+
+func (w *workerCgroup) attach(attr *syscall.SysProcAttr) {}
+
+func (w *workerCgroup) release() (cgroupUsage, error) {
+	return cgroupUsage{-1, -1}, nil
+}
+
+func jobCgroupUsage() cgroupUsage {
+	return cgroupUsage{-1, -1}
+}
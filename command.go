@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// shellPath is the shell used to run mapper and reducer commands in --shell mode.
+const shellPath = "/bin/sh"
+
+// commandArgs turns a mapper or reducer command into the argv of the process to start. In --shell
+// mode the command is handed to the shell as is, otherwise it is split with parseCommand.
+func commandArgs(command string) ([]string, error) {
+	if shell {
+		return []string{shellPath, "-c", command}, nil
+	}
+	return parseCommand(command)
+}
+
+// parseCommand splits a command into arguments following the POSIX shell quoting rules:
+//
+//   - unquoted blanks separate arguments
+//   - a backslash outside of quotes preserves the literal value of the next character, a
+//     backslash followed by a newline is removed as a line continuation
+//   - characters between single quotes are preserved literally
+//   - characters between double quotes are preserved literally except for a backslash followed
+//     by one of $ ` " \ or a newline
+//
+// No expansion of variables, globs or command substitutions is performed and operators such as
+// pipes and redirects are passed on as regular arguments, use --shell for those.
+func parseCommand(command string) ([]string, error) {
+	args := []string{}
+	arg := []rune{}
+	inArg := false
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch c {
+		case ' ', '\t', '\n':
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+		case '\\':
+			i++
+			if i == len(runes) {
+				return nil, errors.New("command ends with an unescaped backslash")
+			}
+			// a backslash followed by a newline continues the line and is removed entirely
+			if runes[i] != '\n' {
+				inArg = true
+				arg = append(arg, runes[i])
+			}
+		case '\'':
+			inArg = true
+			j := i + 1
+			for j < len(runes) && runes[j] != '\'' {
+				j++
+			}
+			if j == len(runes) {
+				return nil, fmt.Errorf("unterminated single quote at offset %d", i)
+			}
+			arg = append(arg, runes[i+1:j]...)
+			i = j
+		case '"':
+			inArg = true
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					switch runes[j+1] {
+					case '$', '`', '"', '\\':
+						j++
+					case '\n':
+						j++
+						continue
+					}
+				}
+				arg = append(arg, runes[j])
+			}
+			if j == len(runes) {
+				return nil, fmt.Errorf("unterminated double quote at offset %d", i)
+			}
+			i = j
+		default:
+			inArg = true
+			arg = append(arg, c)
+		}
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
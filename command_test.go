@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tt := range []struct {
+		rule string
+		in   string
+		out  []string
+	}{
+		// unquoted blanks
+		{"blanks", "cat", []string{"cat"}},
+		{"blanks", "  wc \t -l\n", []string{"wc", "-l"}},
+		{"blanks", "python3\tmap.py\n10", []string{"python3", "map.py", "10"}},
+
+		// backslash outside of quotes
+		{"backslash", `echo a\ b`, []string{"echo", "a b"}},
+		{"backslash", `echo \'a\' \"b\"`, []string{"echo", "'a'", `"b"`}},
+		{"backslash", `echo \\ \$HOME \a`, []string{"echo", `\`, "$HOME", "a"}},
+		{"backslash", "echo a\\\nb", []string{"echo", "ab"}},
+		{"backslash", "echo a \\\n b", []string{"echo", "a", "b"}},
+
+		// single quotes
+		{"single quotes", "python -c 'import sys; print(1)'", []string{"python", "-c", "import sys; print(1)"}},
+		{"single quotes", `echo 'a\nb' '\'`, []string{"echo", `a\nb`, `\`}},
+		{"single quotes", `echo '"$x"'`, []string{"echo", `"$x"`}},
+		{"single quotes", "echo 'a\n  b'", []string{"echo", "a\n  b"}},
+
+		// double quotes
+		{"double quotes", `grep "foo bar" in`, []string{"grep", "foo bar", "in"}},
+		{"double quotes", `echo "a \"b\" \$c \d \\"`, []string{"echo", `a "b" $c \d \`}},
+		{"double quotes", "echo \"a\\\nb\"", []string{"echo", "ab"}},
+		{"double quotes", `echo "it's" "\'"`, []string{"echo", "it's", `\'`}},
+		{"double quotes", "echo \"\\`date\\`\"", []string{"echo", "`date`"}},
+
+		// quoted and unquoted parts of one argument are joined
+		{"concatenation", `echo 'a'"b"c`, []string{"echo", "abc"}},
+		{"concatenation", `sort --field-separator=' ' -k2`, []string{"sort", "--field-separator= ", "-k2"}},
+		{"concatenation", `echo '' "" a''b`, []string{"echo", "", "", "ab"}},
+		{"concatenation", `echo 'héllo wörld'`, []string{"echo", "héllo wörld"}},
+
+		// nothing is expanded and operators are plain arguments
+		{"no expansion", "echo $HOME *.txt ~ $(date)", []string{"echo", "$HOME", "*.txt", "~", "$(date)"}},
+		{"no expansion", "echo a | cut -f1 > out", []string{"echo", "a", "|", "cut", "-f1", ">", "out"}},
+	} {
+		out, err := parseCommand(tt.in)
+		if err != nil {
+			t.Errorf("%s: parseCommand(%q) returned error %v", tt.rule, tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("%s: parseCommand(%q) => %q, want %q", tt.rule, tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestParseCommandErrors(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		err string
+	}{
+		{"", "empty command"},
+		{" \t\n", "empty command"},
+		{"\\\n", "empty command"},
+		{"echo 'a", "unterminated single quote at offset 5"},
+		{`echo "a\"`, "unterminated double quote at offset 5"},
+		{`echo "it's`, "unterminated double quote at offset 5"},
+		{`echo a\`, "command ends with an unescaped backslash"},
+	} {
+		out, err := parseCommand(tt.in)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseCommand(%q) => %q, %v, want error %s", tt.in, out, err, tt.err)
+		}
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	defer func(s bool) { shell = s }(shell)
+	command := `grep -c "a b" | sort > $OUT`
+	shell = true
+	if out, _ := commandArgs(command); !reflect.DeepEqual(out, []string{shellPath, "-c", command}) {
+		t.Errorf("commandArgs(%q) with --shell => %q, want the command passed to %s", command, out, shellPath)
+	}
+	shell = false
+	want := []string{"grep", "-c", "a b", "|", "sort", ">", "$OUT"}
+	if out, _ := commandArgs(command); !reflect.DeepEqual(out, want) {
+		t.Errorf("commandArgs(%q) => %q, want %q", command, out, want)
+	}
+}
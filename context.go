@@ -4,51 +4,118 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
-	"strings"
 	"sync"
+	"time"
 )
 
+// killGracePeriod is how long killAll waits for terminated workers to exit before killing them.
+const killGracePeriod = 5 * time.Second
+
+// stderrGracePeriod is how long a failing worker waits for the rest of the stderr of its killed
+// process so that the tail is complete.
+const stderrGracePeriod = time.Second
+
 var (
 	mu      sync.Mutex
 	stopped = false
 	procs   = make(map[int]*os.Process)
+	groups  = make(map[int]bool)
+)
+
+const (
+	stageInput  = "input"
+	stageMap    = "map"
+	stageReduce = "reduce"
 )
 
 type context struct {
+	stage    string
 	workerID int
 	mappers  int
 	reducers int
 }
 
+// limits returns the resource limits of the stage the worker belongs to.
+func (c context) limits() limits {
+	switch c.stage {
+	case stageInput:
+		return noLimits
+	case stageReduce:
+		return reducerLimits
+	}
+	return mapperLimits
+}
+
 func (c context) err(msg string) error {
+	if c.stage == stageInput {
+		return fmt.Errorf("error in input command: %s", msg)
+	}
 	return fmt.Errorf("error in worker.%d: %s", c.workerID, msg)
 }
 
 func (c context) log(msg string) {
-	log.Printf("  [worker.%d] %s", c.workerID, msg)
+	c.logEvent(levelInfo, "worker", msg)
 }
 
 func (c context) logf(format string, v ...interface{}) {
 	c.log(fmt.Sprintf(format, v...))
 }
 
+// logEvent logs a message of the worker, see the package level logEvent.
+func (c context) logEvent(level int, event, msg string) {
+	logEvent(level, c.stage, c.workerID, event, msg)
+}
+
 func (c context) exec(
 	command string,
 	stdinHandler func(context, io.WriteCloser) error,
 	stdoutHandler func(context, io.ReadCloser) error,
 	stderrHandler func(context, io.ReadCloser) error,
-) error {
-	args := strings.Fields(command)
+) (err error) {
+	args, err := commandArgs(command)
+	if err != nil {
+		return c.err(fmt.Sprintf("failed parsing command %s - %v", command, err))
+	}
 	cmd := exec.Command(args[0], args[1:]...)
+	l := c.limits()
+	if l.isSet() {
+		if cmd.Err != nil {
+			return c.err(fmt.Sprintf("failed starting command %q - %v", args, cmd.Err))
+		}
+		argv, err := l.command(cmd.Path, args)
+		if err != nil {
+			return c.err(fmt.Sprintf("failed applying limits to command %q - %v", args, err))
+		}
+		cmd = exec.Command(argv[0], argv[1:]...)
+	}
+	cmd.SysProcAttr = sysProcAttr()
+	var cg *workerCgroup
+	if hasCgroup() {
+		w, err := newWorkerCgroup(fmt.Sprintf("%s-%d", c.stage, c.workerID))
+		if err != nil {
+			return c.err(fmt.Sprintf("failed creating cgroup - %v", err))
+		}
+		w.attach(cmd.SysProcAttr)
+		cg = w
+		defer func() {
+			usage, err := w.release()
+			if err != nil {
+				c.logf("failed removing cgroup - %v", err)
+			}
+			recordCgroupUsage(c, usage)
+		}()
+	}
 	cmd.Env = append(
 		os.Environ(),
 		fmt.Sprintf("WORKER_ID=%d", c.workerID),
 		fmt.Sprintf("MAPPERS=%d", c.mappers),
 		fmt.Sprintf("REDUCERS=%d", c.reducers),
 	)
+	if l.isSet() {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", limitsEnv, l))
+	}
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return err
@@ -61,19 +128,97 @@ func (c context) exec(
 	if err != nil {
 		return err
 	}
-	errc := make(chan error)
-	go func() { errc <- stdinHandler(c, stdin) }()
-	go func() { errc <- stdoutHandler(c, stdout) }()
-	go func() { errc <- stderrHandler(c, stderr) }()
+	stdinStream, stdoutStream := newStream("stdin"), newStream("stdout")
+	var stdinActive, stdoutActive time.Duration
+	errc := make(chan error, 3)
+	go func() {
+		start := time.Now()
+		err := stdinHandler(c, streamWriter{stdin, stdinStream})
+		stdinActive = time.Since(start)
+		errc <- err
+	}()
+	go func() {
+		start := time.Now()
+		err := stdoutHandler(c, streamReader{stdout, stdoutStream})
+		stdoutActive = time.Since(start)
+		errc <- err
+	}()
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		errc <- stderrHandler(c, stderr)
+	}()
 	if err := start(cmd); err != nil {
-		return err
+		return c.err(fmt.Sprintf("failed starting command %q - %v", args, err))
+	}
+	defer func() {
+		if err != nil {
+			err = c.withStderr(err)
+		}
+	}()
+	started := time.Now()
+	traceArgs := map[string]interface{}{"argv": args, "pid": cmd.Process.Pid}
+	endTrace := c.traceSpan("process", traceArgs)
+	defer func() {
+		if cmd.ProcessState != nil {
+			traceArgs["exit"] = cmd.ProcessState.String()
+			c.recordUsage(cmd.ProcessState, time.Since(started))
+		}
+		endTrace()
+	}()
+	stopWatch := func() bool { return false }
+	if l.rss > 0 {
+		stopWatch = watchRSS(cmd.Process.Pid, l.rss, cg)
+	}
+	// the input command runs for the whole map stage and is paced by the mappers, so the timeouts
+	// only apply to mappers and reducers
+	var timeout, stallCheck <-chan time.Time
+	if workerTimeout > 0 && c.stage != stageInput {
+		t := time.NewTimer(workerTimeout)
+		defer t.Stop()
+		timeout = t.C
 	}
-	for i := 0; i < 3; i++ {
-		if err := <-errc; err != nil {
+	if stallTimeout > 0 && c.stage != stageInput {
+		t := time.NewTicker(stallTimeout / 4)
+		defer t.Stop()
+		stallCheck = t.C
+	}
+	for i := 0; i < 3; {
+		var err error
+		select {
+		case err = <-errc:
+			i++
+		case <-timeout:
+			err = c.err(fmt.Sprintf("command %q timed out after %s", args, workerTimeout))
+		case <-stallCheck:
+			if err = stalled(stallTimeout, stdinStream, stdoutStream); err != nil {
+				err = c.err(fmt.Sprintf("command %q %v", args, err))
+			}
+		}
+		if err != nil {
+			// the handler error may have been caused by the worker dying, so kill and reap it to
+			// find out whether it hit one of its limits
+			killGroup(cmd.Process.Pid)
+			select {
+			case <-stderrDone:
+			case <-time.After(stderrGracePeriod):
+			}
+			wait(cmd)
+			if v := l.violation(cmd.ProcessState, stopWatch()); v != "" {
+				return c.err(fmt.Sprintf("command %q exceeded its %s", args, v))
+			}
 			return err
 		}
 	}
-	return wait(cmd)
+	c.recordPipes(stdinStream, stdoutStream, stdinActive, stdoutActive)
+	err = wait(cmd)
+	if v := l.violation(cmd.ProcessState, stopWatch()); v != "" {
+		return c.err(fmt.Sprintf("command %q exceeded its %s", args, v))
+	}
+	if err != nil {
+		return c.err(fmt.Sprintf("command %q failed - %v%s", args, err, l.hint()))
+	}
+	return nil
 }
 
 func start(c *exec.Cmd) error {
@@ -85,7 +230,9 @@ func start(c *exec.Cmd) error {
 	if err := c.Start(); err != nil {
 		return err
 	}
+	pruneGroups()
 	procs[c.Process.Pid] = c.Process
+	groups[c.Process.Pid] = true
 	return nil
 }
 
@@ -93,15 +240,56 @@ func wait(c *exec.Cmd) error {
 	err := c.Wait()
 	mu.Lock()
 	delete(procs, c.Process.Pid)
+	pruneGroups()
 	mu.Unlock()
 	return err
 }
 
+// pruneGroups forgets the process groups whose leader has been reaped and that have no processes
+// left, mu must be held. The id of a process group is not reused while the group has members, so a
+// group that is pruned as soon as it is found empty still belongs to this job when it is signalled.
+func pruneGroups() {
+	for pid := range groups {
+		if procs[pid] == nil && !groupExists(pid) {
+			delete(groups, pid)
+		}
+	}
+}
+
+// killAll stops any new processes from being started and terminates the process groups of all
+// workers. Groups that have not exited after killGracePeriod are killed.
 func killAll() {
 	mu.Lock()
-	defer mu.Unlock()
 	stopped = true
-	for _, p := range procs {
-		p.Kill()
+	pruneGroups()
+	for pid := range groups {
+		terminateGroup(pid)
+	}
+	mu.Unlock()
+	for deadline := time.Now().Add(killGracePeriod); time.Now().Before(deadline); {
+		if liveGroups() == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	pruneGroups()
+	for pid := range groups {
+		killGroup(pid)
+	}
+}
+
+// liveGroups returns the number of worker process groups that still have running processes.
+func liveGroups() int {
+	mu.Lock()
+	defer mu.Unlock()
+	pruneGroups()
+	n := 0
+	for pid := range groups {
+		if groupExists(pid) {
+			n++
+		}
 	}
+	return n
 }
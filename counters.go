@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Workers report counters and status messages to xrt by writing lines in the following formats
+// to stderr:
+//
+//	xrt:counter:<group>:<name>:<increment>
+//	xrt:status:<message>
+//
+// Counters are aggregated across all workers and printed in the job summary.
+const (
+	reportPrefix  = "xrt:"
+	counterPrefix = reportPrefix + "counter:"
+	statusPrefix  = reportPrefix + "status:"
+)
+
+type counterKey struct {
+	group string
+	name  string
+}
+
+var (
+	countersMu sync.Mutex
+	counters   = make(map[counterKey]int64)
+
+	// statuses holds the last status message reported by each worker, keyed by "<stage>.<id>".
+	statuses = make(map[string]string)
+)
+
+// parseCounter parses the part of a counter report following counterPrefix.
+func parseCounter(report string) (counterKey, int64, error) {
+	i := strings.LastIndexByte(report, ':')
+	if i == -1 {
+		return counterKey{}, 0, fmt.Errorf("missing increment")
+	}
+	n, err := strconv.ParseInt(report[i+1:], 10, 64)
+	if err != nil {
+		return counterKey{}, 0, fmt.Errorf("bad increment '%s'", report[i+1:])
+	}
+	gn := strings.SplitN(report[:i], ":", 2)
+	if len(gn) != 2 || gn[0] == "" || gn[1] == "" {
+		return counterKey{}, 0, fmt.Errorf("expected <group>:<name>:<increment>")
+	}
+	return counterKey{gn[0], gn[1]}, n, nil
+}
+
+// report handles a line written by a worker to stderr. It returns false if the line is not a
+// counter or status report and should be logged as is.
+func report(c context, line string) bool {
+	switch {
+	case strings.HasPrefix(line, counterPrefix):
+		key, n, err := parseCounter(line[len(counterPrefix):])
+		if err != nil {
+			c.logEvent(levelWarn, "counter", fmt.Sprintf("malformed counter report '%s' - %v", line, err))
+			return true
+		}
+		incrCounter(key.group, key.name, n)
+	case strings.HasPrefix(line, statusPrefix):
+		msg := line[len(statusPrefix):]
+		countersMu.Lock()
+		statuses[fmt.Sprintf("%s.%d", c.stage, c.workerID)] = msg
+		countersMu.Unlock()
+		c.logEvent(levelInfo, "status", fmt.Sprintf("status: %s", msg))
+	default:
+		return false
+	}
+	return true
+}
+
+func incrCounter(group, name string, n int64) {
+	countersMu.Lock()
+	counters[counterKey{group, name}] += n
+	countersMu.Unlock()
+}
+
+// sortedCounters returns the counter keys ordered by group and name.
+func sortedCounters() []counterKey {
+	keys := make([]counterKey, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
+
+// logCounters logs all counters reported by workers, grouped by counter group.
+func logCounters() {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	if len(counters) == 0 {
+		return
+	}
+	infof("counters", "  counters:")
+	group := ""
+	for _, k := range sortedCounters() {
+		if k.group != group {
+			group = k.group
+			infof("counters", "    %s", group)
+		}
+		infof("counters", "      %s: %d", k.name, counters[k])
+	}
+}
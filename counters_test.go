@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCounter(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		key counterKey
+		n   int64
+		err string
+	}{
+		{"records:skipped:1", counterKey{"records", "skipped"}, 1, ""},
+		{"parse:errors:-2", counterKey{"parse", "errors"}, -2, ""},
+		{"parse:errors:+3", counterKey{"parse", "errors"}, 3, ""},
+		// the group ends at the first colon and the increment starts after the last one, names
+		// may contain colons
+		{"business:revenue:usd:1000", counterKey{"business", "revenue:usd"}, 1000, ""},
+		{"a:b:c:d:0", counterKey{"a", "b:c:d"}, 0, ""},
+		{"records: skipped :1", counterKey{"records", " skipped "}, 1, ""},
+
+		{"", counterKey{}, 0, "missing increment"},
+		{"records", counterKey{}, 0, "missing increment"},
+		{"records:skipped:", counterKey{}, 0, "bad increment ''"},
+		{"records:skipped:x", counterKey{}, 0, "bad increment 'x'"},
+		{"records:skipped: 1", counterKey{}, 0, "bad increment ' 1'"},
+		{"records:skipped:1.5", counterKey{}, 0, "bad increment '1.5'"},
+		{"records:skipped:9223372036854775808", counterKey{}, 0, "bad increment"},
+		{"records:1", counterKey{}, 0, "expected <group>:<name>:<increment>"},
+		{":skipped:1", counterKey{}, 0, "expected <group>:<name>:<increment>"},
+		{"records::1", counterKey{}, 0, "expected <group>:<name>:<increment>"},
+	} {
+		key, n, err := parseCounter(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseCounter(%q) => %v, %d, %v, want error %q", tt.in, key, n, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || key != tt.key || n != tt.n {
+			t.Errorf("parseCounter(%q) => %v, %d, %v, want %v, %d", tt.in, key, n, err, tt.key, tt.n)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	defer func() { counters = make(map[counterKey]int64) }()
+	counters = make(map[counterKey]int64)
+	for _, r := range []string{
+		"records:skipped:2",
+		"bytes:out:10",
+		"records:read:5",
+		"records:skipped:-1",
+		"bytes:out:10",
+		"records:skipped:3",
+	} {
+		key, n, err := parseCounter(r)
+		if err != nil {
+			t.Fatalf("parseCounter(%q) => %v", r, err)
+		}
+		incrCounter(key.group, key.name, n)
+	}
+	want := map[counterKey]int64{
+		{"bytes", "out"}:       20,
+		{"records", "read"}:    5,
+		{"records", "skipped"}: 4,
+	}
+	if !reflect.DeepEqual(counters, want) {
+		t.Errorf("counters => %v, want %v", counters, want)
+	}
+	order := []counterKey{{"bytes", "out"}, {"records", "read"}, {"records", "skipped"}}
+	if keys := sortedCounters(); !reflect.DeepEqual(keys, order) {
+		t.Errorf("sortedCounters() => %v, want %v", keys, order)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+)
+
+var (
+	// recordDelimiter ends every record, on input, on mapper and reducer input and output, and
+	// keyDelimiter separates the partition from the record on mapper output. They are set by
+	// --record-delimiter and --key-delimiter.
+	recordDelimiter byte = '\n'
+	keyDelimiter    byte = '\t'
+
+	// recordEnd is what is written after each record, \r\n for --record-delimiter=\r\n and
+	// recordDelimiter otherwise. With \r\n records are split on \n by scanRecords, which drops
+	// the \r, and it is written back by writing recordEnd.
+	recordEnd = []byte{recordDelimiter}
+)
+
+// parseDelimiter parses a --record-delimiter or --key-delimiter value, a single character or one
+// of the escapes \n, \r, \t, \0 and \\. The only delimiter of two characters accepted is \r\n.
+func parseDelimiter(v string) ([]byte, error) {
+	d := []byte{}
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i == len(v)-1 {
+			d = append(d, v[i])
+			continue
+		}
+		i++
+		switch v[i] {
+		case 'n':
+			d = append(d, '\n')
+		case 'r':
+			d = append(d, '\r')
+		case 't':
+			d = append(d, '\t')
+		case '0':
+			d = append(d, 0)
+		case '\\':
+			d = append(d, '\\')
+		default:
+			return nil, fmt.Errorf("unknown escape \\%c", v[i])
+		}
+	}
+	if len(d) == 1 || bytes.Equal(d, []byte("\r\n")) {
+		return d, nil
+	}
+	return nil, fmt.Errorf("delimiter must be a single character or \\r\\n")
+}
+
+// setDelimiters sets the record delimiter, which may be \r\n, and the key delimiter.
+func setDelimiters(record []byte, key byte) {
+	recordDelimiter, keyDelimiter = record[len(record)-1], key
+	recordEnd = record
+}
+
+// scanRecords is a bufio.SplitFunc splitting the data into records on recordDelimiter. For \n
+// delimited records it is bufio.ScanLines, which also drops a trailing \r.
+func scanRecords(data []byte, atEOF bool) (int, []byte, error) {
+	if recordDelimiter == '\n' {
+		return bufio.ScanLines(data, atEOF)
+	}
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, recordDelimiter); i >= 0 {
+		return i + 1, data[0:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
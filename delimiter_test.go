@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDelimiter(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		out []byte
+		err string
+	}{
+		{"|", []byte{'|'}, ""},
+		{",", []byte{','}, ""},
+		{"\x01", []byte{1}, ""},
+		{`\n`, []byte{'\n'}, ""},
+		{`\r`, []byte{'\r'}, ""},
+		{`\t`, []byte{'\t'}, ""},
+		{`\0`, []byte{0}, ""},
+		{`\\`, []byte{'\\'}, ""},
+		// a trailing backslash is not an escape
+		{`\`, []byte{'\\'}, ""},
+		{`\r\n`, []byte("\r\n"), ""},
+		{"\r\n", []byte("\r\n"), ""},
+
+		{`\x`, nil, `unknown escape \x`},
+		{`\N`, nil, `unknown escape \N`},
+		{"", nil, "must be a single character"},
+		{"ab", nil, "must be a single character"},
+		{`\n\n`, nil, "must be a single character"},
+		{`\n\r`, nil, "must be a single character"},
+		{`\\\`, nil, "must be a single character"},
+	} {
+		d, err := parseDelimiter(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseDelimiter(%q) => %q, %v, want error %q", tt.in, d, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(d, tt.out) {
+			t.Errorf("parseDelimiter(%q) => %q, %v, want %q", tt.in, d, err, tt.out)
+		}
+	}
+}
+
+func TestScanRecords(t *testing.T) {
+	defer setDelimiters([]byte{'\n'}, '\t')
+	for _, tt := range []struct {
+		delimiter string
+		in        string
+		out       []string
+	}{
+		{"\n", "a\nb\n", []string{"a", "b"}},
+		{"\n", "a\n\nb", []string{"a", "", "b"}},
+		// \n delimited records keep dropping a \r before the \n like bufio.ScanLines
+		{"\n", "a\r\nb\r\n", []string{"a", "b"}},
+		{"\r\n", "a\r\nb\nc\r", []string{"a", "b", "c"}},
+		{"\x00", "a b\x00c\nd\x00", []string{"a b", "c\nd"}},
+		{"\x00", "a\r\x00", []string{"a\r"}},
+		{"|", "a||b", []string{"a", "", "b"}},
+		{"|", "", nil},
+	} {
+		setDelimiters([]byte(tt.delimiter), '\t')
+		s := bufio.NewScanner(strings.NewReader(tt.in))
+		s.Split(scanRecords)
+		var out []string
+		for s.Scan() {
+			out = append(out, s.Text())
+		}
+		if err := s.Err(); err != nil || !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("scanning %q delimited by %q => %q, %v, want %q", tt.in, tt.delimiter, out, err, tt.out)
+		}
+		if !bytes.Equal(recordEnd, []byte(tt.delimiter)) {
+			t.Errorf("recordEnd for %q => %q", tt.delimiter, recordEnd)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// With --framed records are exchanged with workers as length prefixed binary frames instead of
+// delimited text, which allows records to hold any bytes. Input files and the stdin of workers
+// hold records framed as
+//
+//	<varint length><bytes>
+//
+// and mapper stdout additionally prefixes every record with its partition
+//
+//	<varint partition><varint length><bytes>
+//
+// The varints use the same encoding as spill files, see writeVarInt and readVarInt.
+
+// writeFrame writes a framed record and returns the number of bytes written.
+func writeFrame(w *bufio.Writer, record []byte) (int, error) {
+	if err := writeVarInt(w, len(record)); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(record)
+	return varIntSize(len(record)) + n, err
+}
+
+func varIntSize(n int) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size++
+	}
+	return size
+}
+
+// framedMapOutput reads the framed records written by a mapper.
+type framedMapOutput struct {
+	r         *bufio.Reader
+	partition int
+	buf       []byte
+	n         int
+	e         error
+}
+
+func newFramedMapOutput(r io.Reader) *framedMapOutput {
+	return &framedMapOutput{r: bufio.NewReader(r)}
+}
+
+func (o *framedMapOutput) next() bool {
+	if o.e != nil {
+		return false
+	}
+	p, err := readVarInt(o.r)
+	if err == io.EOF {
+		return false
+	}
+	if err != nil {
+		o.e = fmt.Errorf("error reading partition of framed record: %v", err)
+		return false
+	}
+	n, err := readVarInt(o.r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		o.e = fmt.Errorf("error reading length of framed record: %v", err)
+		return false
+	}
+	if n < 0 || n > memory {
+		o.e = fmt.Errorf(
+			"record is too large to fit in memory - required: %db but memory can only hold %db",
+			n,
+			memory,
+		)
+		return false
+	}
+	if n > cap(o.buf) {
+		o.buf = make([]byte, 4096*(n/4096)+4096)
+	}
+	o.buf = o.buf[:n]
+	if _, err := io.ReadFull(o.r, o.buf); err != nil {
+		o.e = fmt.Errorf("error reading framed record: %v", err)
+		return false
+	}
+	o.partition = p
+	o.n = varIntSize(p) + varIntSize(n) + n
+	return true
+}
+
+func (o *framedMapOutput) record() (int, []byte, error) {
+	if o.partition < 0 || reducers <= o.partition {
+		return 0, nil, fmt.Errorf("partition key was %d - needs to be in [0, %d)", o.partition, reducers)
+	}
+	return o.partition, o.buf, nil
+}
+
+func (o *framedMapOutput) raw() []byte {
+	return o.buf
+}
+
+func (o *framedMapOutput) size() int {
+	return o.n
+}
+
+func (o *framedMapOutput) err() error {
+	return o.e
+}
+
+// frameCounter counts the framed records in a stream written in arbitrary pieces.
+type frameCounter struct {
+	skip   int  // bytes left of the current record
+	length int  // length of the next record read so far
+	shift  uint // bits of length read so far
+}
+
+// count returns the number of records whose length ends in p.
+func (f *frameCounter) count(p []byte) int64 {
+	n := int64(0)
+	for len(p) > 0 {
+		if f.skip > 0 {
+			k := f.skip
+			if len(p) < k {
+				k = len(p)
+			}
+			p, f.skip = p[k:], f.skip-k
+			continue
+		}
+		b := p[0]
+		p = p[1:]
+		f.length |= int(b&0x7F) << f.shift
+		if b&0x80 != 0 {
+			f.shift += 7
+			continue
+		}
+		n++
+		f.skip, f.length, f.shift = f.length, 0, 0
+	}
+	return n
+}
+
+// offsetReader counts the bytes read through it.
+type offsetReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// framedChunks splits a framed input file of size bytes into chunks of about chunkSize bytes, which
+// are passed to send as they are found. Chunks start and end on record boundaries, which are found
+// by reading the length of every record.
+func framedChunks(filename string, size int64, send func(*chunk)) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	or := &offsetReader{r: f}
+	r := bufio.NewReader(or)
+	start := int64(0)
+	for {
+		offset := or.offset - int64(r.Buffered())
+		if offset-start >= chunkSize {
+			send(&chunk{filename, start, offset, nil, nil, nil})
+			start = offset
+		}
+		n, err := readVarInt(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading framed record at %s:%d: %v", filename, offset, err)
+		}
+		if m, err := r.Discard(n); err != nil {
+			return fmt.Errorf(
+				"truncated framed record at %s:%d, read %d of %d bytes", filename, offset, m, n,
+			)
+		}
+	}
+	if start < size {
+		send(&chunk{filename, start, size, nil, nil, nil})
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestFrameCounter(t *testing.T) {
+	records := generateTestRecords()
+	records = append(records, bytes.Repeat([]byte{0x80}, 20000))
+	b := &bytes.Buffer{}
+	w := bufio.NewWriter(b)
+	size := 0
+	for _, record := range records {
+		n, err := writeFrame(w, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += n
+	}
+	w.Flush()
+	if size != b.Len() {
+		t.Errorf("writeFrame reported %d bytes written, want %d", size, b.Len())
+	}
+	for _, piece := range []int{1, 7, 4096, b.Len()} {
+		f := &frameCounter{}
+		n := int64(0)
+		for p := b.Bytes(); len(p) > 0; {
+			k := piece
+			if len(p) < k {
+				k = len(p)
+			}
+			n += f.count(p[:k])
+			p = p[k:]
+		}
+		if n != int64(len(records)) {
+			t.Errorf("count in pieces of %d bytes => %d records, want %d", piece, n, len(records))
+		}
+	}
+}
+
+func TestFramedMapOutputCorrupt(t *testing.T) {
+	defer func(m, r int) { memory, reducers = m, r }(memory, reducers)
+	memory, reducers = 1024, 2
+	maxUint64 := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	for _, tt := range []struct {
+		name   string
+		output []byte
+		bad    bool
+	}{
+		{"partition too long", bytes.Repeat([]byte{0x80}, 11), false},
+		{"partition overflows", append(bytes.Repeat([]byte{0xff}, 9), 0x02), false},
+		{"negative partition", append(maxUint64, 0x01, 'a'), false},
+		{"negative length", append([]byte{0x00}, maxUint64...), false},
+		{"length above memory", []byte{0x00, 0x81, 0x08, 'a'}, false},
+		{"truncated record", []byte{0x00, 0x05, 'a'}, false},
+		{"partition out of range", []byte{0x02, 0x01, 'a'}, true},
+	} {
+		o := newFramedMapOutput(bytes.NewReader(tt.output))
+		if !o.next() {
+			if tt.bad || o.err() == nil {
+				t.Errorf("next(%s) => error %v", tt.name, o.err())
+			}
+			continue
+		}
+		if _, _, err := o.record(); !tt.bad || err == nil {
+			t.Errorf("record(%s) => error %v, want a bad record", tt.name, err)
+		}
+	}
+}
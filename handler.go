@@ -8,29 +8,29 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"sync/atomic"
 )
 
-const (
-	recordDelimiter = '\n'
-	keyDelimiter    = '\t'
-)
-
-func logStream(c context, r io.ReadCloser) error {
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-		c.log(s.Text())
-	}
-	return s.Err()
-}
+// maxPartitionPrefix is the longest partition number and delimiter allowed on mapper output.
+const maxPartitionPrefix = 32
 
 func inputStream(c context, w io.WriteCloser, inputChunks chan *chunk) error {
 	var f *os.File
 	var err error
-	for chunk := range inputChunks {
+	st := c.stats()
+	cw := newCountingWriter(w, &st.InputBytes, &st.InputRecords)
+	for {
+		// waiting for a chunk is not the worker stalling
+		done := waitOn(w)
+		chunk, ok := <-inputChunks
+		done()
+		if !ok {
+			break
+		}
 		if chunk.err != nil {
 			return c.err(chunk.err.Error())
 		}
-		if f == nil || f.Name() != chunk.filename {
+		if chunk.data == nil && chunk.files == nil && (f == nil || f.Name() != chunk.filename) {
 			if f != nil {
 				if err = f.Close(); err != nil {
 					return err
@@ -41,10 +41,19 @@ func inputStream(c context, w io.WriteCloser, inputChunks chan *chunk) error {
 				return err
 			}
 		}
-		c.logf("processing %s [%d:%d]", chunk.filename, chunk.start, chunk.end)
-		if err := chunk.copyChunk(f, w); err != nil {
+		if !quiet {
+			c.logEvent(levelInfo, "chunk", "processing "+chunk.describe())
+		}
+		endTrace := c.traceSpan("chunk", map[string]interface{}{
+			"file":  chunk.filename,
+			"start": chunk.start,
+			"end":   chunk.end,
+			"files": len(chunk.files),
+		})
+		if err := chunk.copyChunk(f, cw); err != nil {
 			return c.err(err.Error())
 		}
+		endTrace()
 	}
 	if f != nil {
 		if err := f.Close(); err != nil {
@@ -61,24 +70,119 @@ func outputStream(c context, r io.ReadCloser, output string) error {
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(f, r); err != nil {
+	st := c.stats()
+	if _, err := io.Copy(newCountingWriter(f, &st.OutputBytes, &st.OutputRecords), r); err != nil {
 		return err
 	}
 	return f.Close()
 }
 
 func intermediateMapStream(c context, r io.ReadCloser, buffers []*buffer) error {
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-		i, record, err := parse(s.Bytes())
+	st := c.stats()
+	bad := &badRecordWriter{c: c}
+	out := newMapOutput(r)
+	for out.next() {
+		i, record, err := out.record()
 		if err != nil {
-			return err
+			if err := bad.add(out.raw(), err); err != nil {
+				bad.close()
+				return err
+			}
+			continue
 		}
-		if err := buffers[i].add(record); err != nil {
+		if err := addRecord(r, buffers[i], record); err != nil {
 			return err
 		}
+		atomic.AddInt64(&st.OutputRecords, 1)
+		atomic.AddInt64(&st.OutputBytes, int64(out.size()))
+		atomic.AddInt64(&st.Partitions[i].Records, 1)
+		atomic.AddInt64(&st.Partitions[i].Bytes, int64(len(record)))
+	}
+	if err := out.err(); err != nil {
+		bad.close()
+		return c.err(err.Error())
+	}
+	return bad.close()
+}
+
+// addRecord adds a record read from the mapper stdout r to a buffer. While the buffer spills the
+// mapper waits on xrt to read its output, which does not count towards a stall.
+func addRecord(r io.Reader, b *buffer, record []byte) error {
+	if !b.spillsOn(record) {
+		return b.add(record)
+	}
+	defer waitOn(r)()
+	return b.add(record)
+}
+
+// writeWorkerRecord writes a record to the stdin of a worker followed by recordEnd, or framed by
+// its length with --framed, and returns the number of bytes written.
+func writeWorkerRecord(w *bufio.Writer, record []byte) (int, error) {
+	if framed {
+		return writeFrame(w, record)
+	}
+	n, err := w.Write(record)
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(recordEnd)
+	return n + m, err
+}
+
+// mapOutput reads the partitioned records written by a mapper.
+type mapOutput interface {
+	// next reads the next record and returns false at the end of the output or on error.
+	next() bool
+	// record returns the partition and record of the last record read, or the error that makes
+	// it a bad record.
+	record() (int, []byte, error)
+	// raw returns the last record read as written by the mapper and size the bytes it took,
+	// including any delimiter or framing.
+	raw() []byte
+	size() int
+	err() error
+}
+
+func newMapOutput(r io.Reader) mapOutput {
+	if framed {
+		return newFramedMapOutput(r)
+	}
+	s := bufio.NewScanner(r)
+	// allow records of up to the whole memory budget, larger records are rejected by the buffers
+	// anyway and the partition prefix is at most a few bytes. The scanner buffer is not part of the
+	// budget, it only grows to the longest record but can reach --memory for every mapper.
+	s.Buffer(nil, memory+maxPartitionPrefix)
+	s.Split(scanRecords)
+	return textMapOutput{s}
+}
+
+// textMapOutput reads records delimited by recordDelimiter, each prefixed by the partition and
+// keyDelimiter.
+type textMapOutput struct {
+	s *bufio.Scanner
+}
+
+func (o textMapOutput) next() bool {
+	return o.s.Scan()
+}
+
+func (o textMapOutput) record() (int, []byte, error) {
+	return parse(o.s.Bytes())
+}
+
+func (o textMapOutput) raw() []byte {
+	return o.s.Bytes()
+}
+
+func (o textMapOutput) size() int {
+	return len(o.s.Bytes()) + len(recordEnd)
+}
+
+func (o textMapOutput) err() error {
+	if err := o.s.Err(); err != bufio.ErrTooLong {
+		return err
 	}
-	return s.Err()
+	return fmt.Errorf("record is too large to fit in memory - memory can only hold %db", memory)
 }
 
 func parse(record []byte) (int, []byte, error) {
@@ -93,6 +197,9 @@ func parse(record []byte) (int, []byte, error) {
 	if p < 0 || reducers <= p {
 		return 0, []byte{}, fmt.Errorf("partition key was %d - needs to be in [0, %d)", p, reducers)
 	}
+	if stop == len(record) {
+		return p, record[stop:], nil
+	}
 	return p, record[stop+1 : len(record)], nil
 }
 
@@ -106,17 +213,22 @@ func intermediateReduceStream(c context, w io.WriteCloser, buffers []*buffer) er
 			scanners = append(scanners, newFileScanner(filename))
 		}
 	}
+	defer c.traceSpan("merge", map[string]interface{}{"runs": len(scanners)})()
+	// the reducer waits on xrt while the merger reads the head of every run
+	done := waitOn(w)
 	m, err := newMerger(scanners)
+	done()
 	if err != nil {
 		return err
 	}
+	st := c.stats()
 	for m.next() {
-		if _, err := wb.Write(m.nextRecord()); err != nil {
-			return err
-		}
-		if err := wb.WriteByte(recordDelimiter); err != nil {
+		n, err := writeWorkerRecord(wb, m.nextRecord())
+		if err != nil {
 			return err
 		}
+		atomic.AddInt64(&st.InputRecords, 1)
+		atomic.AddInt64(&st.InputBytes, int64(n))
 	}
 	if err := m.err(); err != nil {
 		return err
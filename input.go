@@ -1,32 +1,95 @@
 package main
 
 import (
+	"bufio"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
-	"path/filepath"
 	"regexp"
+	"sort"
+	"sync/atomic"
 )
 
 const (
-	chunkSize       int64 = 16 << 20 // 16mb
-	recordSeparator byte  = '\n'
+	defaultChunkSize = "16m"
+	chunkSizeAuto    = "auto"
+
+	// chunksPerMapper is the number of chunks --chunk-size=auto aims to give every mapper, which
+	// balances the load when chunks take different times to process.
+	chunksPerMapper        = 4
+	minAutoChunkSize int64 = 1 << 20   // 1mb
+	maxAutoChunkSize int64 = 256 << 20 // 256mb
 )
 
+// chunkSize is the size of input chunks, set by --chunk-size.
+var chunkSize int64 = 16 << 20 // 16mb
+
+// autoChunkSize returns the chunk size for --chunk-size=auto, which splits total bytes of input
+// into chunksPerMapper chunks per mapper within the bounds of minAutoChunkSize and
+// maxAutoChunkSize.
+func autoChunkSize(total int64, mappers int) int64 {
+	size := total / int64(mappers*chunksPerMapper)
+	if size < minAutoChunkSize {
+		return minAutoChunkSize
+	}
+	if size > maxAutoChunkSize {
+		return maxAutoChunkSize
+	}
+	return size
+}
+
+// stdinInput is the --input value that reads the input from stdin.
+const stdinInput = "-"
+
+// chunk is a part of an input file from start to end, when data is set a part of stdin held in
+// memory and when files is set a combination of small files, which are read whole and hold end
+// bytes in total.
 type chunk struct {
 	filename string
 	start    int64
 	end      int64
+	data     []byte
+	files    []inputFile
 	err      error
 }
 
+// size returns the number of input bytes in the chunk.
+func (c *chunk) size() int64 {
+	return c.end - c.start
+}
+
+// describe describes the chunk in the log.
+func (c *chunk) describe() string {
+	if c.files != nil {
+		return fmt.Sprintf("%d files %s ... %s [%d bytes]", len(c.files), c.files[0].name, c.files[len(c.files)-1].name, c.end)
+	}
+	return fmt.Sprintf("%s [%d:%d]", c.filename, c.start, c.end)
+}
+
+// copyChunk writes the records of the chunk to w, the stdin of a mapper. Chunks of a file start
+// after the first record delimiter past their start, unless they start the file, and run up to and
+// including the first delimiter past their end. A file that does not end with a delimiter has
+// recordEnd written after its last record, so that it is not joined with the first record of the
+// next file the mapper reads.
 func (c *chunk) copyChunk(f *os.File, w io.Writer) error {
+	if c.data != nil {
+		_, err := w.Write(c.data)
+		return err
+	}
+	if c.files != nil {
+		return c.copyFiles(w)
+	}
 	buf := make([]byte, 1)
 	if _, err := f.Seek(c.start, 0); err != nil {
 		return err
 	}
+	if framed {
+		// framed chunks start and end on record boundaries
+		_, err := io.CopyN(w, f, c.end-c.start)
+		return err
+	}
 	if c.start > 0 {
 		for {
 			c.start++
@@ -40,46 +103,93 @@ func (c *chunk) copyChunk(f *os.File, w io.Writer) error {
 			if c.start == c.end {
 				return nil
 			}
-			if buf[0] == recordSeparator {
+			if buf[0] == recordDelimiter {
 				break
 			}
 		}
 	}
-	if _, err := io.CopyN(w, f, c.end-c.start); err != nil {
+	lw := &lastByteWriter{w: w, last: -1}
+	if _, err := io.CopyN(lw, f, c.end-c.start); err != nil {
 		return err
 	}
 	for {
 		_, err := f.Read(buf)
 		if err == io.EOF {
-			return nil
+			return lw.endRecord()
 		}
 		if err != nil {
 			return err
 		}
-		if _, err := w.Write(buf); err != nil {
+		if _, err := lw.Write(buf); err != nil {
 			return err
 		}
-		if buf[0] == recordSeparator {
+		if buf[0] == recordDelimiter {
 			return nil
 		}
 	}
 }
 
-func enumerateChunks(input string) (chan *chunk, error) {
-	abs, err := filepath.Abs(input)
-	if err != nil {
-		return nil, err
+// copyFiles copies the files of a combined chunk, each ended like the last chunk of a file.
+func (c *chunk) copyFiles(w io.Writer) error {
+	for _, f := range c.files {
+		data, err := ioutil.ReadFile(f.name)
+		if err != nil {
+			return err
+		}
+		lw := &lastByteWriter{w: w, last: -1}
+		if _, err := lw.Write(data); err != nil {
+			return err
+		}
+		if err := lw.endRecord(); err != nil {
+			return err
+		}
 	}
-	regex, err := extractRegex(abs)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// lastByteWriter remembers the last byte written through it, -1 before anything is written.
+type lastByteWriter struct {
+	w    io.Writer
+	last int
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.last = int(p[n-1])
 	}
-	root, err := extractRoot(abs)
-	if err != nil {
-		return nil, err
+	return n, err
+}
+
+// endRecord writes recordEnd unless the data written so far ends with recordDelimiter, which is
+// used at the end of a file so that its last record is not joined with the first record of
+// whatever the mapper reads next. Framed records need no delimiter.
+func (w *lastByteWriter) endRecord() error {
+	if framed || w.last < 0 || byte(w.last) == recordDelimiter {
+		return nil
 	}
+	_, err := w.w.Write(recordEnd)
+	return err
+}
+
+// enumerateChunks finds the input files, or stdin for -, and returns the channel their chunks are
+// sent on. The files are all found before it returns, which makes inputTotal final.
+func enumerateChunks(patterns []string, list string, excludes []string) (chan *chunk, error) {
 	chunks := make(chan *chunk)
-	go startWalk(root, regex, chunks)
+	if len(patterns) == 1 && patterns[0] == stdinInput && list == "" {
+		go startStdin(os.Stdin, chunks)
+		return chunks, nil
+	}
+	var err error
+	if inputFiles, err = findInputs(patterns, list, excludes); err != nil {
+		return nil, err
+	}
+	inputTotal = inputSize(inputFiles)
+	if chunkSizeString == chunkSizeAuto {
+		chunkSize = autoChunkSize(inputTotal, mappers)
+	}
+	atomic.StoreInt32(&walkDone, 1)
+	go startChunks(inputFiles, chunks)
 	return chunks, nil
 }
 
@@ -103,13 +213,27 @@ func extractRoot(input string) (string, error) {
 	return root, nil
 }
 
+// extractRegex translates a glob into a regular expression. A * does not match across directories,
+// ** does and **/ matches any number of directories, including none.
 func extractRegex(input string) (*regexp.Regexp, error) {
 	regex := "^"
-	for _, c := range input {
+	in := []rune(input)
+	for i := 0; i < len(in); i++ {
+		c := in[i]
 		switch c {
 		case '.', '$', '(', ')', '|', '+':
 			regex = fmt.Sprintf("%s%c", regex, '\\')
 		case '*':
+			if i+1 < len(in) && in[i+1] == '*' {
+				i++
+				if i+1 < len(in) && in[i+1] == '/' {
+					i++
+					regex = fmt.Sprintf("%s%s", regex, "(?:.*/)?")
+				} else {
+					regex = fmt.Sprintf("%s%s", regex, ".*")
+				}
+				continue
+			}
 			regex = fmt.Sprintf("%s%s", regex, "[^/]")
 		case '?':
 			regex = fmt.Sprintf("%s%c", regex, '.')
@@ -129,37 +253,178 @@ func extractRegex(input string) (*regexp.Regexp, error) {
 	return regexp.Compile(fmt.Sprintf("%s$", regex))
 }
 
-func startWalk(root string, regex *regexp.Regexp, chunks chan *chunk) {
-	if err := walk(root, regex, chunks); err != nil {
-		chunks <- &chunk{"", -1, -1, err}
+// startChunks sends the chunks of the input files. Framed files of chunkSize or more are split on
+// record boundaries while their chunks are sent, so that mappers start before the files have been
+// read, and go first since their chunks are the largest. All other chunks are planned up front and
+// sent largest first so the map stage does not end waiting on a mapper that started a large chunk
+// last.
+func startChunks(files []inputFile, chunks chan *chunk) {
+	planned, framedFiles := planChunks(files)
+	for _, f := range framedFiles {
+		err := framedChunks(f.name, f.size, func(c *chunk) {
+			chunks <- c
+		})
+		if err != nil {
+			chunks <- &chunk{"", -1, -1, nil, nil, err}
+			close(chunks)
+			return
+		}
+	}
+	sort.SliceStable(planned, func(i, j int) bool {
+		return planned[i].size() > planned[j].size()
+	})
+	for _, c := range planned {
+		chunks <- c
 	}
 	close(chunks)
 }
 
-func walk(filename string, regex *regexp.Regexp, chunks chan *chunk) error {
-	s, err := os.Stat(filename)
-	if err != nil {
-		return err
+// planChunks splits the input files into chunks, except for framed files of chunkSize or more
+// which are returned to be split by framedChunks. Files smaller than chunkSize are combined into
+// chunks of up to chunkSize bytes, which saves opening, seeking and logging every small file.
+func planChunks(files []inputFile) ([]*chunk, []inputFile) {
+	planned := []*chunk{}
+	var framedFiles, small []inputFile
+	size := int64(0)
+	combine := func() {
+		switch len(small) {
+		case 0:
+			return
+		case 1:
+			planned = append(planned, &chunk{small[0].name, 0, small[0].size, nil, nil, nil})
+		default:
+			planned = append(planned, &chunk{"", 0, size, nil, small, nil})
+		}
+		small, size = nil, 0
 	}
-	if s.Mode().IsRegular() && regex.Match([]byte(filename)) {
-		start := int64(0)
-		for start+chunkSize < s.Size() {
-			chunks <- &chunk{filename, start, start + chunkSize, nil}
-			start += chunkSize
+	for _, f := range files {
+		if f.size >= chunkSize && framed {
+			framedFiles = append(framedFiles, f)
+			continue
 		}
-		chunks <- &chunk{filename, start, s.Size(), nil}
-		return nil
+		if f.size >= chunkSize {
+			planned = fileChunks(f, planned)
+			continue
+		}
+		if size+f.size > chunkSize {
+			combine()
+		}
+		small = append(small, f)
+		size += f.size
+	}
+	combine()
+	return planned, framedFiles
+}
+
+// fileChunks appends the chunks of chunkSize bytes of an input file to planned.
+func fileChunks(f inputFile, planned []*chunk) []*chunk {
+	start := int64(0)
+	for start+chunkSize < f.size {
+		planned = append(planned, &chunk{f.name, start, start + chunkSize, nil, nil, nil})
+		start += chunkSize
+	}
+	return append(planned, &chunk{f.name, start, f.size, nil, nil, nil})
+}
+
+func startStdin(r io.Reader, chunks chan *chunk) {
+	if err := readChunks(r, chunks); err != nil {
+		chunks <- &chunk{"", -1, -1, nil, nil, fmt.Errorf("error reading stdin: %v", err)}
+	}
+	atomic.StoreInt32(&walkDone, 1)
+	close(chunks)
+}
+
+// startInputCmd runs the --input-cmd command and cuts its stdout into chunks the same way as
+// stdin. The chunks are closed once the command has exited successfully, a failing command rolls
+// back the job.
+func startInputCmd(command string, chunks chan *chunk) {
+	c := context{stageInput, 0, mappers, reducers}
+	c.log("input command starting")
+	stdin := func(c context, w io.WriteCloser) error {
+		return w.Close()
+	}
+	stdout := func(c context, r io.ReadCloser) error {
+		return readChunks(r, chunks)
 	}
-	if s.Mode().IsDir() {
-		fis, err := ioutil.ReadDir(filename)
+	if err := c.exec(command, stdin, stdout, logStream); err != nil {
+		rollback(err)
+	}
+	c.log("done")
+	atomic.StoreInt32(&walkDone, 1)
+	close(chunks)
+}
+
+// readChunks cuts r into in-memory chunks of at least chunkSize bytes, extended to the end of the
+// record they end in. The time spent waiting for busy mappers to take a chunk is marked as waiting
+// on xrt on the stream of r, if it has one.
+func readChunks(r io.Reader, chunks chan *chunk) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	start := int64(0)
+	for {
+		data := make([]byte, chunkSize)
+		n, err := io.ReadFull(br, data)
+		data = data[:n]
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		} else if err == nil {
+			if data, err = readRecordEnd(br, data); err == io.EOF {
+				err = nil
+			}
+		}
 		if err != nil {
 			return err
 		}
-		for _, fi := range fis {
-			if err := walk(path.Join(filename, fi.Name()), regex, chunks); err != nil {
-				return err
+		if len(data) == 0 {
+			return nil
+		}
+		atomic.AddInt64(&inputTotal, int64(len(data)))
+		done := waitOn(r)
+		chunks <- &chunk{stdinInput, start, start + int64(len(data)), data, nil, nil}
+		done()
+		start += int64(len(data))
+	}
+}
+
+// readRecordEnd appends the rest of the record data ends in to data, which is up to and including
+// the next recordDelimiter or, with --framed, the rest of the partially read frames.
+func readRecordEnd(r *bufio.Reader, data []byte) ([]byte, error) {
+	if !framed {
+		rest, err := r.ReadBytes(recordDelimiter)
+		return append(data, rest...), err
+	}
+	// walk the frames read so far to find how much of the last one is missing
+	i := 0
+	for {
+		n, m := binary.Uvarint(data[i:])
+		if m == 0 {
+			// the length itself is cut, read it byte by byte
+			b, err := r.ReadByte()
+			if err != nil {
+				return data, err
 			}
+			data = append(data, b)
+			continue
+		}
+		if m < 0 {
+			return data, fmt.Errorf("invalid framed record length at input offset %d", i)
+		}
+		if n > uint64(memory) {
+			return data, fmt.Errorf(
+				"record is too large to fit in memory - required: %db but memory can only hold %db",
+				n,
+				memory,
+			)
+		}
+		i += m + int(n)
+		if i >= len(data) {
+			rest := make([]byte, i-len(data))
+			if _, err := io.ReadFull(r, rest); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return data, err
+			}
+			return append(data, rest...), nil
 		}
 	}
-	return nil
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -22,6 +28,8 @@ var extractTests = []struct {
 	{"/foo/[^a-b]/bar", "/foo/", "^/foo/[^a-b]/bar$"},
 	{"/foo/{a,b}/bar", "/foo/", "^/foo/(?:a|b)/bar$"},
 	{"/foo/b+r.biz", "/foo/", "^/foo/b\\+r\\.biz$"},
+	{"/foo/**/bar", "/foo/", "^/foo/(?:.*/)?bar$"},
+	{"/foo/**", "/foo/", "^/foo/.*$"},
 }
 
 func TestExtractRoot(t *testing.T) {
@@ -47,3 +55,210 @@ func TestExtractRegex(t *testing.T) {
 		}
 	}
 }
+
+func TestReadRecordEnd(t *testing.T) {
+	defer func(f bool, m int) { framed, memory = f, m }(framed, memory)
+	memory = 1 << 20
+	b := &bytes.Buffer{}
+	w := bufio.NewWriter(b)
+	for _, record := range generateTestRecords() {
+		writeFrame(w, record)
+	}
+	w.Flush()
+	frames := b.Bytes()
+	lines := []byte("first line\nsecond line\nthird line\n")
+	for _, tt := range []struct {
+		framed bool
+		input  []byte
+	}{{false, lines}, {true, frames}} {
+		framed = tt.framed
+		for cut := 1; cut < len(tt.input); cut += 1 + cut%97 {
+			data, err := readRecordEnd(bufio.NewReader(bytes.NewReader(tt.input[cut:])), tt.input[:cut:cut])
+			if err != nil {
+				t.Fatalf("readRecordEnd(framed %v, cut %d) returned error %v", tt.framed, cut, err)
+			}
+			rest := tt.input[len(data):]
+			if !bytes.Equal(data, tt.input[:len(data)]) || (!tt.framed && data[len(data)-1] != '\n') {
+				t.Fatalf("readRecordEnd(framed %v, cut %d) did not end on a record boundary", tt.framed, cut)
+			}
+			if tt.framed && len(rest) > 0 {
+				if n, err := readVarInt(bufio.NewReader(bytes.NewReader(rest))); err != nil || n > len(rest) {
+					t.Fatalf("readRecordEnd(framed %v, cut %d) did not end on a frame boundary", tt.framed, cut)
+				}
+			}
+		}
+	}
+}
+
+func TestReadRecordEndCorrupt(t *testing.T) {
+	defer func(f bool, m int) { framed, memory = f, m }(framed, memory)
+	framed, memory = true, 1024
+	for _, tt := range []struct {
+		name string
+		data []byte
+		rest []byte
+	}{
+		{"length overflows", bytes.Repeat([]byte{0xff}, 10), []byte{0x7f}},
+		{"length too long", bytes.Repeat([]byte{0x80}, 11), nil},
+		{"length cut and too long", []byte{0x80}, bytes.Repeat([]byte{0x80}, 10)},
+		{"length above memory", []byte{0x81, 0x08, 'a'}, bytes.Repeat([]byte{'a'}, 2000)},
+		{"negative length", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, nil},
+	} {
+		if _, err := readRecordEnd(bufio.NewReader(bytes.NewReader(tt.rest)), tt.data); err == nil {
+			t.Errorf("readRecordEnd(%s) returned no error", tt.name)
+		}
+	}
+}
+
+func TestFindInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xrt-input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"a.tsv", "b.tmp", "_SUCCESS", ".hidden.tsv", "x/c.tsv", "x/y/d.tsv", "_tmp/e.tsv",
+		"x/_part",
+	} {
+		filename := path.Join(dir, name)
+		os.MkdirAll(path.Dir(filename), 0755)
+		ioutil.WriteFile(filename, []byte("record\n"), 0644)
+	}
+	list := path.Join(dir, "_list")
+	ioutil.WriteFile(list, []byte(path.Join(dir, "_SUCCESS")+"\n\n"+path.Join(dir, "a.tsv")+"\n"), 0644)
+	for _, tt := range []struct {
+		patterns []string
+		list     string
+		excludes []string
+		out      []string
+	}{
+		{[]string{dir + "/*"}, "", nil, []string{"a.tsv", "b.tmp"}},
+		{[]string{dir + "/*"}, "", []string{"*.tmp"}, []string{"a.tsv"}},
+		{[]string{dir + "/**/*.tsv"}, "", nil, []string{"a.tsv", "x/c.tsv", "x/y/d.tsv"}},
+		{[]string{dir + "/**/*.tsv"}, "", []string{dir + "/x/**"}, []string{"a.tsv"}},
+		{[]string{dir + "/x/*", dir + "/**/c.tsv"}, "", nil, []string{"x/c.tsv"}},
+		{nil, list, nil, []string{"_SUCCESS", "a.tsv"}},
+		{[]string{dir + "/_SUCCESS", dir + "/.hidden.tsv"}, "", nil, []string{"_SUCCESS", ".hidden.tsv"}},
+		{[]string{dir + "/*/_part", dir + "/*/e.tsv"}, "", nil, []string{"x/_part"}},
+	} {
+		files, err := findInputs(tt.patterns, tt.list, tt.excludes)
+		if err != nil {
+			t.Fatalf("findInputs(%v, %s, %v) returned error %v", tt.patterns, tt.list, tt.excludes, err)
+		}
+		out := []string{}
+		for _, f := range files {
+			out = append(out, f.name[len(dir)+1:])
+		}
+		if strings.Join(out, " ") != strings.Join(tt.out, " ") {
+			t.Errorf("findInputs(%v, %s, %v) => %v, want %v", tt.patterns, tt.list, tt.excludes, out, tt.out)
+		}
+	}
+}
+
+func TestAutoChunkSize(t *testing.T) {
+	for _, tt := range []struct {
+		total   int64
+		mappers int
+		out     int64
+	}{
+		{0, 4, minAutoChunkSize},
+		{100 << 20, 32, minAutoChunkSize},
+		{1 << 30, 8, 32 << 20},
+		{2 << 40, 32, maxAutoChunkSize},
+	} {
+		if out := autoChunkSize(tt.total, tt.mappers); out != tt.out {
+			t.Errorf("autoChunkSize(%d, %d) => %d, want %d", tt.total, tt.mappers, out, tt.out)
+		}
+	}
+}
+
+func TestPlanChunks(t *testing.T) {
+	defer func(size int64) { chunkSize = size }(chunkSize)
+	chunkSize = 10
+	planned, _ := planChunks([]inputFile{{"a", 4}, {"b", 25}, {"c", 3}, {"d", 3}, {"e", 4}, {"f", 10}})
+	out := []string{}
+	for _, c := range planned {
+		if c.files != nil {
+			out = append(out, fmt.Sprintf("%d files [%d]", len(c.files), c.end))
+		} else {
+			out = append(out, fmt.Sprintf("%s [%d:%d]", c.filename, c.start, c.end))
+		}
+	}
+	want := "b [0:10] b [10:20] b [20:25] 3 files [10] f [0:10] e [0:4]"
+	if strings.Join(out, " ") != want {
+		t.Errorf("planChunks => %s, want %s", strings.Join(out, " "), want)
+	}
+}
+
+func TestCopyChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xrt-chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []inputFile{}
+	for _, content := range []string{"a\nb", "c\n", "", "d\ne\nf"} {
+		filename := path.Join(dir, fmt.Sprintf("f%d", len(files)))
+		ioutil.WriteFile(filename, []byte(content), 0644)
+		files = append(files, inputFile{filename, int64(len(content))})
+	}
+	for _, tt := range []struct {
+		chunks []*chunk
+		out    string
+	}{
+		{[]*chunk{{files: files[:3], end: 5}}, "a\nb\nc\n"},
+		{[]*chunk{{filename: files[0].name, end: 3}}, "a\nb\n"},
+		{[]*chunk{{filename: files[3].name, end: 2}, {filename: files[3].name, start: 2, end: 5}}, "d\ne\nf\n"},
+		{[]*chunk{{filename: files[3].name, end: 3}, {filename: files[3].name, start: 3, end: 5}}, "d\ne\nf\n"},
+	} {
+		b := &bytes.Buffer{}
+		for _, c := range tt.chunks {
+			var f *os.File
+			if c.files == nil {
+				if f, err = os.Open(c.filename); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.copyChunk(f, b); err != nil {
+				t.Fatalf("copyChunk(%s) returned error %v", c.describe(), err)
+			}
+			if f != nil {
+				f.Close()
+			}
+		}
+		if b.String() != tt.out {
+			t.Errorf("copyChunk(%s) => %q, want %q", tt.chunks[0].describe(), b.String(), tt.out)
+		}
+	}
+}
+
+func TestFindInputsOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xrt-input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	want := []string{}
+	// more directories than walkers so that some are walked by the calling goroutine
+	for i := 0; i < 3*walkers; i++ {
+		for j := 0; j < 3; j++ {
+			name := fmt.Sprintf("d%02d/e/f%d", i, j)
+			os.MkdirAll(path.Dir(path.Join(dir, name)), 0755)
+			ioutil.WriteFile(path.Join(dir, name), nil, 0644)
+			want = append(want, name)
+		}
+	}
+	for n := 0; n < 5; n++ {
+		files, err := findInputs([]string{dir + "/**"}, "", nil)
+		if err != nil {
+			t.Fatalf("findInputs returned error %v", err)
+		}
+		out := []string{}
+		for _, f := range files {
+			out = append(out, f.name[len(dir)+1:])
+		}
+		if strings.Join(out, " ") != strings.Join(want, " ") {
+			t.Fatalf("findInputs => %v, want %v", out, want)
+		}
+	}
+}
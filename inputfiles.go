@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// inputFiles are the files selected by --input, --input-list and --exclude.
+var inputFiles []inputFile
+
+// patternList is a flag that may be set more than once, like --input and --exclude.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// inputFile is a regular file selected as input.
+type inputFile struct {
+	name string
+	size int64
+}
+
+// inputSelection collects the input files, skipping excluded files and files found twice.
+type inputSelection struct {
+	excludes []*regexp.Regexp
+	files    []inputFile
+	seen     map[string]bool
+	walkers  chan struct{}
+}
+
+// walkers is the number of directories walked in parallel.
+const walkers = 16
+
+// findInputs returns the files matched by the glob patterns and listed in the list file, one path
+// per line, that do not match any of the exclude patterns. Files are returned in the order they are
+// found and only once. Hidden files and directories, whose name starts with . or _ like _SUCCESS,
+// are skipped while walking unless --include-hidden is set or their name is given literally.
+func findInputs(patterns []string, list string, excludes []string) ([]inputFile, error) {
+	s := &inputSelection{seen: make(map[string]bool), walkers: make(chan struct{}, walkers)}
+	for _, e := range excludes {
+		regex, err := excludeRegex(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %s - %v", e, err)
+		}
+		s.excludes = append(s.excludes, regex)
+	}
+	for _, p := range patterns {
+		if p == stdinInput {
+			return nil, fmt.Errorf("%s can not be combined with other input", stdinInput)
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		regex, err := extractRegex(abs)
+		if err != nil {
+			return nil, err
+		}
+		root, err := extractRoot(abs)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.walk(root, regex, literalParts(abs)); err != nil {
+			return nil, err
+		}
+	}
+	if list != "" {
+		if err := s.readList(list); err != nil {
+			return nil, err
+		}
+	}
+	return s.files, nil
+}
+
+// excludeRegex translates an exclude pattern into a regular expression. Patterns without a / are
+// matched against the file name, all others against the absolute path.
+func excludeRegex(pattern string) (*regexp.Regexp, error) {
+	if !strings.Contains(pattern, "/") {
+		return extractRegex(pattern)
+	}
+	abs, err := filepath.Abs(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return extractRegex(abs)
+}
+
+func (s *inputSelection) excluded(filename string) bool {
+	for _, regex := range s.excludes {
+		if regex.MatchString(filename) || regex.MatchString(path.Base(filename)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *inputSelection) add(filename string, size int64) {
+	if s.seen[filename] || s.excluded(filename) {
+		return
+	}
+	s.seen[filename] = true
+	s.files = append(s.files, inputFile{filename, size})
+}
+
+// literalParts returns the path components of a glob up to the first **, with the components that
+// hold a wildcard left empty. Hidden names given literally are not skipped while walking.
+func literalParts(pattern string) []string {
+	parts := strings.Split(pattern, "/")
+	for i, part := range parts {
+		if strings.Contains(part, "**") {
+			return parts[:i]
+		}
+		if strings.ContainsAny(part, "*?{[") {
+			parts[i] = ""
+		}
+	}
+	return parts
+}
+
+// walk adds the files found under filename that match regex, literals are the literal path
+// components of the pattern, see literalParts.
+func (s *inputSelection) walk(filename string, regex *regexp.Regexp, literals []string) error {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	files, err := s.walkInfo(filename, st, regex, literals)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		s.add(f.name, f.size)
+	}
+	return nil
+}
+
+// walkInfo returns the files found under filename that match regex in directory order.
+// Subdirectories are walked in parallel by up to walkers goroutines at a time, and by the
+// calling goroutine when none is free. Hidden names are skipped unless they are given literally.
+func (s *inputSelection) walkInfo(
+	filename string,
+	st os.FileInfo,
+	regex *regexp.Regexp,
+	literals []string,
+) ([]inputFile, error) {
+	if st.Mode().IsRegular() && regex.MatchString(filename) {
+		return []inputFile{{filename, st.Size()}}, nil
+	}
+	if !st.Mode().IsDir() {
+		return nil, nil
+	}
+	fis, err := ioutil.ReadDir(filename)
+	if err != nil {
+		return nil, err
+	}
+	found := make([][]inputFile, len(fis))
+	errs := make([]error, len(fis))
+	var wg sync.WaitGroup
+	for i, fi := range fis {
+		name := path.Join(filename, fi.Name())
+		if hidden(fi.Name()) && !includeHidden && !isLiteral(name, literals) {
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(name); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		if !fi.IsDir() {
+			found[i], errs[i] = s.walkInfo(name, fi, regex, literals)
+			continue
+		}
+		select {
+		case s.walkers <- struct{}{}:
+			wg.Add(1)
+			go func(i int, name string, fi os.FileInfo) {
+				defer wg.Done()
+				found[i], errs[i] = s.walkInfo(name, fi, regex, literals)
+				<-s.walkers
+			}(i, name, fi)
+		default:
+			found[i], errs[i] = s.walkInfo(name, fi, regex, literals)
+		}
+	}
+	wg.Wait()
+	files := []inputFile{}
+	for i := range fis {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		files = append(files, found[i]...)
+	}
+	return files, nil
+}
+
+// readList adds the files listed in the --input-list file. Blank lines are ignored.
+func (s *inputSelection) readList(list string) error {
+	f, err := os.Open(list)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		abs, err := filepath.Abs(line)
+		if err != nil {
+			return err
+		}
+		st, err := os.Stat(abs)
+		if err != nil {
+			return err
+		}
+		if !st.Mode().IsRegular() {
+			return fmt.Errorf("%s in %s is not a regular file", line, list)
+		}
+		s.add(abs, st.Size())
+	}
+	return sc.Err()
+}
+
+// isLiteral reports whether the last component of filename is given literally by the pattern.
+func isLiteral(filename string, literals []string) bool {
+	d := strings.Count(filename, "/")
+	return d < len(literals) && literals[d] == path.Base(filename)
+}
+
+func hidden(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// inputSize returns the total size of the input files.
+func inputSize(files []inputFile) int64 {
+	size := int64(0)
+	for _, f := range files {
+		size += f.size
+	}
+	return size
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// limits are the resource limits applied to the worker processes of a stage. Zero values mean no
+// limit is applied, except for ionice where -1 leaves the io priority untouched.
+type limits struct {
+	as     int  // address space in bytes (RLIMIT_AS)
+	rss    int  // resident set size in bytes, enforced by polling the worker
+	cpu    int  // cpu time in seconds (RLIMIT_CPU)
+	nofile int  // number of open files (RLIMIT_NOFILE)
+	nice   int  // scheduling priority
+	ionice int  // best-effort io priority 0-7 or ioniceIdle
+	pin    bool // pin worker i to the i:th available cpu
+}
+
+// ioniceIdle selects the idle io scheduling class.
+const ioniceIdle = 8
+
+const (
+	// limitsHelperArg as the first argument runs xrt as the helper that applies the limits passed
+	// in limitsEnv to itself before executing the worker command, see execLimited.
+	limitsHelperArg = "--xrt-exec-limited"
+	limitsEnv       = "XRT_LIMITS"
+)
+
+var noLimits = limits{ionice: -1}
+
+// parseLimits parses a comma separated list of limits, for example:
+//
+//	as=2g,rss=1g,cpu=600,nofile=1024,nice=10,ionice=7,pin
+//
+// Memory amounts use the same format as --memory and cpu time is given in seconds.
+func parseLimits(v string) (limits, error) {
+	l := noLimits
+	if v == "" {
+		return l, nil
+	}
+	for _, opt := range strings.Split(v, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if kv[0] == "pin" && len(kv) == 1 {
+			l.pin = true
+			continue
+		}
+		if len(kv) != 2 {
+			return l, fmt.Errorf("invalid limit '%s'", opt)
+		}
+		var err error
+		switch kv[0] {
+		case "as":
+			l.as, err = parseLimitMemory(kv[1])
+		case "rss":
+			l.rss, err = parseLimitMemory(kv[1])
+		case "cpu":
+			l.cpu, err = parseLimitInt(kv[1], 1, -1)
+		case "nofile":
+			l.nofile, err = parseLimitInt(kv[1], 1, -1)
+		case "nice":
+			l.nice, err = parseLimitInt(kv[1], -20, 19)
+		case "ionice":
+			if kv[1] == "idle" {
+				l.ionice = ioniceIdle
+			} else {
+				l.ionice, err = parseLimitInt(kv[1], 0, 7)
+			}
+		default:
+			return l, fmt.Errorf("unknown limit '%s'", kv[0])
+		}
+		if err != nil {
+			return l, fmt.Errorf("invalid limit '%s' - %v", opt, err)
+		}
+	}
+	return l, nil
+}
+
+// String formats the limits the way parseLimits parses them.
+func (l limits) String() string {
+	opts := []string{}
+	if l.as > 0 {
+		opts = append(opts, fmt.Sprintf("as=%db", l.as))
+	}
+	if l.rss > 0 {
+		opts = append(opts, fmt.Sprintf("rss=%db", l.rss))
+	}
+	if l.cpu > 0 {
+		opts = append(opts, fmt.Sprintf("cpu=%d", l.cpu))
+	}
+	if l.nofile > 0 {
+		opts = append(opts, fmt.Sprintf("nofile=%d", l.nofile))
+	}
+	if l.nice != 0 {
+		opts = append(opts, fmt.Sprintf("nice=%d", l.nice))
+	}
+	if l.ionice == ioniceIdle {
+		opts = append(opts, "ionice=idle")
+	} else if l.ionice >= 0 {
+		opts = append(opts, fmt.Sprintf("ionice=%d", l.ionice))
+	}
+	if l.pin {
+		opts = append(opts, "pin")
+	}
+	return strings.Join(opts, ",")
+}
+
+func parseLimitMemory(v string) (int, error) {
+	if v == "" {
+		return 0, fmt.Errorf("empty memory amount")
+	}
+	n := parseMemory(v)
+	if n <= 0 {
+		return 0, fmt.Errorf("bad memory amount %s", v)
+	}
+	return n, nil
+}
+
+func parseLimitInt(v string, min, max int) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || (max >= min && n > max) {
+		return 0, fmt.Errorf("%d is out of range", n)
+	}
+	return n, nil
+}
+
+// isSet reports whether any limit needs to be applied.
+func (l limits) isSet() bool {
+	return l != noLimits
+}
+
+// violation returns a description of the limit a worker hit given its exit state and whether the
+// rss watcher killed it. The cpu time limit is only blamed when the worker was killed by the kernel
+// enforcing it, see cpuLimitKilled, a worker that exits by itself after using its cpu time or that
+// xrt killed for another reason has not hit it. If no limit can be blamed an empty string is
+// returned.
+func (l limits) violation(state *os.ProcessState, rssExceeded bool) string {
+	if rssExceeded {
+		return fmt.Sprintf("rss limit of %s", formatMemory(l.rss))
+	}
+	if l.cpu > 0 && cpuLimitKilled(state, l.cpu) {
+		return fmt.Sprintf("cpu time limit of %ds", l.cpu)
+	}
+	return ""
+}
+
+// hint returns a note naming the limits that make a process fail without a distinguishable exit
+// status, such as allocations failing due to the address space limit.
+func (l limits) hint() string {
+	hints := []string{}
+	if l.as > 0 {
+		hints = append(hints, fmt.Sprintf("address space limit of %s", formatMemory(l.as)))
+	}
+	if l.nofile > 0 {
+		hints = append(hints, fmt.Sprintf("open file limit of %d", l.nofile))
+	}
+	if l.cpu > 0 {
+		// a process started by the worker may have been killed for its cpu time
+		hints = append(hints, fmt.Sprintf("cpu time limit of %ds", l.cpu))
+	}
+	if len(hints) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (the worker may have hit its %s)", strings.Join(hints, " or "))
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// rssPollInterval is how often the resident set size of a worker is checked against its limit.
+const rssPollInterval = 100 * time.Millisecond
+
+// cpuLimitGrace is the number of seconds a worker may run past its cpu time limit after receiving
+// SIGXCPU before the kernel kills it.
+const cpuLimitGrace = 5
+
+// command returns the command line running args with the limits applied. The command is started
+// through xrt itself acting as a helper, which applies the limits to itself and then executes
+// path, so that the limits hold from the first instruction of the worker on and are inherited by
+// every process it starts, like the commands of a --shell pipeline.
+func (l limits) command(path string, args []string) ([]string, error) {
+	return append([]string{"/proc/self/exe", limitsHelperArg, path}, args...), nil
+}
+
+// execLimited is the helper started by command. It applies the limits in limitsEnv to itself,
+// pinning to a cpu picked by WORKER_ID, and executes args[0] with the arguments args[1:]. It only
+// returns on error.
+func execLimited(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("no command given")
+	}
+	// nice, io priority and cpu affinity are set per thread, so they must be set on the thread
+	// that executes the command
+	runtime.LockOSThread()
+	l, err := parseLimits(os.Getenv(limitsEnv))
+	if err != nil {
+		return err
+	}
+	workerID, _ := strconv.Atoi(os.Getenv("WORKER_ID"))
+	if err := l.apply(0, workerID); err != nil {
+		return err
+	}
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, limitsEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	return syscall.Exec(args[0], args[1:], env)
+}
+
+// apply applies the limits to the process pid, or to the calling thread and its process when pid
+// is 0.
+func (l limits) apply(pid, workerID int) error {
+	if l.as > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, uint64(l.as), uint64(l.as)); err != nil {
+			return fmt.Errorf("setting address space limit: %v", err)
+		}
+	}
+	if l.cpu > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_CPU, uint64(l.cpu), uint64(l.cpu+cpuLimitGrace)); err != nil {
+			return fmt.Errorf("setting cpu time limit: %v", err)
+		}
+	}
+	if l.nofile > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_NOFILE, uint64(l.nofile), uint64(l.nofile)); err != nil {
+			return fmt.Errorf("setting open file limit: %v", err)
+		}
+	}
+	if l.nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, l.nice); err != nil {
+			return fmt.Errorf("setting nice priority: %v", err)
+		}
+	}
+	if l.ionice >= 0 {
+		if err := ioprioSet(pid, l.ionice); err != nil {
+			return fmt.Errorf("setting io priority: %v", err)
+		}
+	}
+	if l.pin {
+		if err := pinCPU(pid, workerID); err != nil {
+			return fmt.Errorf("setting cpu affinity: %v", err)
+		}
+	}
+	return nil
+}
+
+// cpuLimitKilled reports whether the process was killed the way the kernel enforces a cpu time
+// limit of cpu seconds, by SIGXCPU at the soft limit or SIGKILL at the hard limit cpuLimitGrace
+// seconds later. xrt itself kills workers with SIGKILL, for their rss limit, on errors and on
+// rollback, so a SIGKILL is only blamed on the cpu time limit once the hard limit was used up.
+func cpuLimitKilled(state *os.ProcessState, cpu int) bool {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return false
+	}
+	// the user and system times in rusage are sampled and can add up to slightly less than the
+	// runtime the kernel enforced the limit on, so allow a tenth of the limit below it
+	cpuTime := (state.UserTime() + state.SystemTime()) * 10 / 9
+	switch ws.Signal() {
+	case syscall.SIGXCPU:
+		return cpuTime >= time.Duration(cpu)*time.Second
+	case syscall.SIGKILL:
+		return cpuTime >= time.Duration(cpu+cpuLimitGrace)*time.Second
+	}
+	return false
+}
+
+func prlimit(pid, resource int, cur, max uint64) error {
+	rlim := syscall.Rlimit{Cur: cur, Max: max}
+	_, _, errno := syscall.RawSyscall6(
+		syscall.SYS_PRLIMIT64,
+		uintptr(pid),
+		uintptr(resource),
+		uintptr(unsafe.Pointer(&rlim)),
+		0, 0, 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func ioprioSet(pid, level int) error {
+	const (
+		ioprioWhoProcess = 1
+		ioprioClassBE    = 2
+		ioprioClassIdle  = 3
+		ioprioClassShift = 13
+	)
+	prio := ioprioClassBE<<ioprioClassShift | level
+	if level == ioniceIdle {
+		prio = ioprioClassIdle << ioprioClassShift
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(prio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cpuMask is a cpu affinity mask large enough for 1024 cpus.
+type cpuMask [16]uint64
+
+// pinCPU pins pid to a single cpu picked by workerID among the cpus xrt itself may run on.
+func pinCPU(pid, workerID int) error {
+	var allowed cpuMask
+	_, _, errno := syscall.RawSyscall(
+		syscall.SYS_SCHED_GETAFFINITY,
+		0,
+		unsafe.Sizeof(allowed),
+		uintptr(unsafe.Pointer(&allowed)),
+	)
+	if errno != 0 {
+		return errno
+	}
+	cpus := []int{}
+	for i := 0; i < len(allowed)*64; i++ {
+		if allowed[i/64]&(1<<uint(i%64)) != 0 {
+			cpus = append(cpus, i)
+		}
+	}
+	if len(cpus) == 0 {
+		return fmt.Errorf("no cpus available")
+	}
+	cpu := cpus[workerID%len(cpus)]
+	var mask cpuMask
+	mask[cpu/64] = 1 << uint(cpu%64)
+	_, _, errno = syscall.RawSyscall(
+		syscall.SYS_SCHED_SETAFFINITY,
+		uintptr(pid),
+		unsafe.Sizeof(mask),
+		uintptr(unsafe.Pointer(&mask)),
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// watchRSS polls the resident set size of the process group led by pid and kills the group once
+// it exceeds max. The rss is read from the worker cgroup cg when it has the memory controller
+// enabled, otherwise from the processes of the group, see groupRSS. The returned function stops
+// the watcher and reports whether the limit was exceeded.
+func watchRSS(pid, max int, cg *workerCgroup) func() bool {
+	stop := make(chan struct{})
+	exceeded := make(chan bool, 1)
+	g := newGroupRSS(pid)
+	go func() {
+		t := time.NewTicker(rssPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				exceeded <- false
+				return
+			case <-t.C:
+				rss, err := cgroupRSS(cg)
+				if err != nil {
+					rss = g.read()
+				}
+				if rss > max {
+					killGroup(pid)
+					<-stop
+					exceeded <- true
+					return
+				}
+			}
+		}
+	}()
+	return func() bool {
+		close(stop)
+		return <-exceeded
+	}
+}
+
+// cgroupRSS returns the anonymous and mapped file memory of the worker cgroup cg, which is what
+// the resident set size of its processes counts. It fails when cg is nil or the memory controller
+// is not enabled for it.
+func cgroupRSS(cg *workerCgroup) (int, error) {
+	if cg == nil {
+		return 0, fmt.Errorf("no cgroup")
+	}
+	b, err := ioutil.ReadFile(path.Join(cg.path, "memory.stat"))
+	if err != nil {
+		return 0, err
+	}
+	rss := 0
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && (fields[0] == "anon" || fields[0] == "file_mapped") {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0, err
+			}
+			rss += n
+		}
+	}
+	return rss, nil
+}
+
+// groupRSS sums the resident set size of the processes of the group led by a worker. Rather than
+// scanning all of /proc it tracks the pids of the group, which are found by following the children
+// of the processes already known, so that processes orphaned by their parent are still counted
+// once they have been seen. A process orphaned within a poll interval of being started is missed.
+type groupRSS struct {
+	pgid int
+	pids map[int]bool
+}
+
+func newGroupRSS(pgid int) *groupRSS {
+	return &groupRSS{pgid, map[int]bool{pgid: true}}
+}
+
+// read returns the total resident set size in bytes of the processes in the group. Processes that
+// have exited or left the group are forgotten.
+func (g *groupRSS) read() int {
+	pending := make([]int, 0, len(g.pids))
+	for pid := range g.pids {
+		pending = append(pending, pid)
+	}
+	seen := make(map[int]bool)
+	total := 0
+	for len(pending) > 0 {
+		pid := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		// processes may exit while the group is read
+		group, rss, err := readStat(pid)
+		if err != nil || group != g.pgid {
+			delete(g.pids, pid)
+			continue
+		}
+		g.pids[pid] = true
+		total += rss
+		pending = append(pending, readChildren(pid)...)
+	}
+	return total
+}
+
+// readChildren returns the child processes of pid, which are listed per thread.
+func readChildren(pid int) []int {
+	fis, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil
+	}
+	children := []int{}
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/task/%s/children", pid, fi.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range strings.Fields(string(b)) {
+			if child, err := strconv.Atoi(f); err == nil {
+				children = append(children, child)
+			}
+		}
+	}
+	return children
+}
+
+// readStat returns the process group and resident set size in bytes of pid, it fails once pid has
+// exited even if it has not been reaped yet.
+func readStat(pid int) (int, int, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// the command name in the second field may contain spaces, the fields after it start with the
+	// state, parent pid and process group and the resident set size in pages is the 24th field
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("unexpected stat format")
+	}
+	fields := bytes.Fields(b[i+1:])
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("unexpected stat format")
+	}
+	if string(fields[0]) == "Z" {
+		return 0, 0, fmt.Errorf("process %d has exited", pid)
+	}
+	group, err := strconv.Atoi(string(fields[2]))
+	if err != nil {
+		return 0, 0, err
+	}
+	pages, err := strconv.Atoi(string(fields[21]))
+	if err != nil {
+		return 0, 0, err
+	}
+	return group, pages * os.Getpagesize(), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGroupRSS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xrt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := path.Join(dir, "pid")
+	// the subshell orphans its sleep once the group has been polled for a while, the orphan must
+	// still be counted
+	cmd := exec.Command("sh", "-c", "(sleep 10 & echo $! > "+pidFile+"; sleep 0.5) ; sleep 10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	g := newGroupRSS(cmd.Process.Pid)
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(rssPollInterval / 10) {
+		g.read()
+	}
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	if !g.pids[orphan] {
+		t.Errorf("read did not track the orphaned process %d, tracked %v", orphan, g.pids)
+	}
+	if rss := g.read(); rss <= 0 {
+		t.Errorf("read => %d, want the rss of the group", rss)
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Wait()
+	for i := 0; i < 100 && len(g.pids) > 0; i++ {
+		time.Sleep(rssPollInterval / 10)
+		g.read()
+	}
+	if len(g.pids) != 0 {
+		t.Errorf("read tracked %v after the group was killed, want none", g.pids)
+	}
+}
+
+func TestCPULimitKilled(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		script string
+		killed bool
+	}{
+		{"exit", "exit 1", false},
+		{"killed by xrt", "kill -KILL $$", false},
+		{"signalled early", "kill -XCPU $$", false},
+		{"soft limit", "ulimit -S -t 1; while :; do :; done", true},
+	} {
+		cmd := exec.Command("sh", "-c", tt.script)
+		cmd.Run()
+		if killed := cpuLimitKilled(cmd.ProcessState, 1); killed != tt.killed {
+			t.Errorf("cpuLimitKilled(%s) => %v, want %v", tt.name, killed, tt.killed)
+		}
+	}
+}
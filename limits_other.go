@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// command fails since resource limits are only supported on linux.
+func (l limits) command(path string, args []string) ([]string, error) {
+	return nil, errors.New("resource limits are only supported on linux")
+}
+
+// execLimited fails since resource limits are only supported on linux.
+func execLimited(args []string) error {
+	return errors.New("resource limits are only supported on linux")
+}
+
+// watchRSS is a no-op since rss limits are only supported on linux.
+func watchRSS(pid, max int, cg *workerCgroup) func() bool {
+	return func() bool { return false }
+}
+
+// cpuLimitKilled is always false since cpu time limits are only supported on linux.
+func cpuLimitKilled(state *os.ProcessState, cpu int) bool {
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		out limits
+	}{
+		{"", noLimits},
+		{"as=1g,rss=512m", limits{as: 1 << 30, rss: 512 << 20, ionice: -1}},
+		{"rss=4096b,cpu=600,nofile=1024", limits{rss: 4096, cpu: 600, nofile: 1024, ionice: -1}},
+		{"nice=-20,ionice=0", limits{nice: -20, ionice: 0}},
+		{"nice=19,ionice=7", limits{nice: 19, ionice: 7}},
+		{"ionice=idle,pin", limits{ionice: ioniceIdle, pin: true}},
+		// a limit given twice keeps the last value, like a repeated flag
+		{"cpu=10,cpu=20", limits{cpu: 20, ionice: -1}},
+	} {
+		out, err := parseLimits(tt.in)
+		if err != nil || out != tt.out {
+			t.Errorf("parseLimits(%q) => %+v, %v, want %+v", tt.in, out, err, tt.out)
+		}
+	}
+}
+
+func TestParseLimitsErrors(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		err string
+	}{
+		{"as", "invalid limit 'as'"},
+		{"as=", "empty memory amount"},
+		{"rss=2x", "bad memory amount 2x"},
+		{"cpu=0", "0 is out of range"},
+		{"nofile=many", "invalid limit 'nofile=many'"},
+		{"nice=20", "20 is out of range"},
+		{"ionice=8", "8 is out of range"},
+		{"pin=1", "unknown limit 'pin'"},
+		{"cpu=10,", "invalid limit ''"},
+		{"mem=1g", "unknown limit 'mem'"},
+	} {
+		out, err := parseLimits(tt.in)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseLimits(%q) => %+v, %v, want error %s", tt.in, out, err, tt.err)
+		}
+	}
+}
+
+// The limits reach the helper that applies them formatted by String in limitsEnv, so every
+// combination has to survive the round trip.
+func TestLimitsString(t *testing.T) {
+	for _, l := range []limits{
+		noLimits,
+		{as: 3 << 20, rss: 1000, ionice: -1},
+		{cpu: 1, nofile: 64, nice: -5, ionice: 0},
+		{ionice: ioniceIdle, pin: true},
+	} {
+		out, err := parseLimits(l.String())
+		if err != nil || out != l {
+			t.Errorf("parseLimits(%q) => %+v, %v, want %+v", l.String(), out, err, l)
+		}
+	}
+	if noLimits.isSet() || noLimits.String() != "" {
+		t.Errorf("noLimits is set as %q, want no limits", noLimits.String())
+	}
+}
+
+func TestLimitsHint(t *testing.T) {
+	for _, tt := range []struct {
+		l    limits
+		hint string
+	}{
+		{noLimits, ""},
+		{limits{rss: 1 << 20, nice: 10, pin: true, ionice: -1}, ""},
+		{limits{as: 1 << 30, ionice: -1}, " (the worker may have hit its address space limit of 1g)"},
+		{
+			limits{nofile: 64, cpu: 5, ionice: -1},
+			" (the worker may have hit its open file limit of 64 or cpu time limit of 5s)",
+		},
+	} {
+		if hint := tt.l.hint(); hint != tt.hint {
+			t.Errorf("%+v.hint() => %q, want %q", tt.l, hint, tt.hint)
+		}
+	}
+}
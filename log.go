@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// log levels, ordered by severity
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// logLevelThreshold is the minimum level of the events that are logged, computed from --log-level.
+var logLevelThreshold = levelInfo
+
+// logEntry is a single event written by --log-format json.
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Stage   string `json:"stage,omitempty"`
+	Worker  *int   `json:"worker,omitempty"`
+	Event   string `json:"event"`
+	Message string `json:"message"`
+}
+
+// parseLevel returns the level named s.
+func parseLevel(s string) (int, bool) {
+	for level, name := range levelNames {
+		if s == name {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// setupLog configures the log package for the log format.
+func setupLog() {
+	if logFormat == logFormatJSON {
+		log.SetFlags(0)
+	}
+}
+
+// logEvent logs msg unless its level is below --log-level. Worker events pass the stage and worker
+// id, xrt events an empty stage. Text output logs xrt messages as is and worker messages prefixed
+// with the worker id, while json output trims the indentation used to structure the text output
+// and drops blank lines.
+func logEvent(level int, stage string, workerID int, event, msg string) {
+	if level < logLevelThreshold {
+		return
+	}
+	if logFormat != logFormatJSON {
+		if stage == stageInput {
+			msg = fmt.Sprintf("  [input] %s", msg)
+		} else if stage != "" {
+			msg = fmt.Sprintf("  [worker.%d] %s", workerID, msg)
+		}
+		log.Print(msg)
+		return
+	}
+	msg = strings.TrimSpace(msg)
+	if msg == "" {
+		return
+	}
+	e := logEntry{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   levelNames[level],
+		Stage:   stage,
+		Event:   event,
+		Message: msg,
+	}
+	if stage != "" {
+		e.Worker = &workerID
+	}
+	b := &bytes.Buffer{}
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(e); err != nil {
+		log.Print(msg)
+		return
+	}
+	log.Print(b.String())
+}
+
+func infof(event, format string, v ...interface{}) {
+	logEvent(levelInfo, "", 0, event, fmt.Sprintf(format, v...))
+}
+
+func warnf(event, format string, v ...interface{}) {
+	logEvent(levelWarn, "", 0, event, fmt.Sprintf(format, v...))
+}
+
+func errorf(event, format string, v ...interface{}) {
+	logEvent(levelError, "", 0, event, fmt.Sprintf(format, v...))
+}
+
+// stderrLevel returns the level of a line written by a worker to stderr. Lines starting with a
+// level name, optionally in brackets, followed by a colon or space have that level ("warning" and
+// "fatal" are accepted as well), all other lines are info.
+func stderrLevel(line string) int {
+	i := strings.IndexAny(line, ": ")
+	if i <= 0 {
+		return levelInfo
+	}
+	switch strings.ToLower(strings.Trim(line[:i], "[]")) {
+	case "debug":
+		return levelDebug
+	case "warn", "warning":
+		return levelWarn
+	case "error", "fatal":
+		return levelError
+	}
+	return levelInfo
+}
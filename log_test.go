@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestStderrLevel(t *testing.T) {
+	for _, tt := range []struct {
+		rule  string
+		line  string
+		level int
+	}{
+		{"no level", "", levelInfo},
+		{"no level", "plain message", levelInfo},
+		{"no level", "record 12 skipped: too long", levelInfo},
+
+		// a level name followed by a colon or space, in any case
+		{"level name", "DEBUG: parsed header", levelDebug},
+		{"level name", "debug parsed header", levelDebug},
+		{"level name", "Warn: slow record", levelWarn},
+		{"level name", "ERROR bad input", levelError},
+		{"level name", "error:", levelError},
+
+		// warning and fatal are aliases
+		{"alias", "warning: slow record", levelWarn},
+		{"alias", "fatal: giving up", levelError},
+
+		// the name may be in brackets
+		{"brackets", "[WARN] slow record", levelWarn},
+		{"brackets", "[error]: bad input", levelError},
+		{"brackets", "[info] started", levelInfo},
+
+		// the name must be the whole first word
+		{"first word", "errors are counted", levelInfo},
+		{"first word", "error", levelInfo},
+		{"first word", "error\tbad input", levelInfo},
+		{"first word", " error: indented", levelInfo},
+		{"first word", ": empty level", levelInfo},
+		{"first word", "python: error: bad input", levelInfo},
+	} {
+		if level := stderrLevel(tt.line); level != tt.level {
+			t.Errorf(
+				"%s: stderrLevel(%q) => %s, want %s",
+				tt.rule, tt.line, levelNames[level], levelNames[tt.level],
+			)
+		}
+	}
+}
@@ -2,60 +2,135 @@ package main
 
 import (
 	"bufio"
-	"errors"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math"
 	"os"
 	"os/signal"
 	"path"
 	"runtime/pprof"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	argInput        = "input"
-	argMapper       = "mapper"
-	argMappers      = "mappers"
-	argMemoryString = "memory"
-	argOutput       = "output"
-	argProfile      = "profile"
-	argReducer      = "reducer"
-	argReducers     = "reducers"
-	argShowVersion  = "version"
-	argTempDir      = "tempdir"
+	argAssign          = "assign"
+	argBadRecords      = "bad-records"
+	argCgroup          = "cgroup"
+	argCgroupCPUs      = "cgroup-cpus"
+	argCgroupMemory    = "cgroup-memory"
+	argChunkSize       = "chunk-size"
+	argExclude         = "exclude"
+	argFramed          = "framed"
+	argHeader          = "header"
+	argHTTP            = "http"
+	argIncludeHidden   = "include-hidden"
+	argInput           = "input"
+	argInputCmd        = "input-cmd"
+	argInputList       = "input-list"
+	argJobDeadline     = "job-deadline"
+	argKeyDelimiter    = "key-delimiter"
+	argLogFormat       = "log-format"
+	argLogLevel        = "log-level"
+	argMapper          = "mapper"
+	argMapperLimits    = "mapper-limits"
+	argMappers         = "mappers"
+	argMemoryString    = "memory"
+	argOutput          = "output"
+	argPrefix          = "prefix"
+	argProfile         = "profile"
+	argProgress        = "progress"
+	argQuiet           = "quiet"
+	argRecordDelimiter = "record-delimiter"
+	argReducer         = "reducer"
+	argReducerLimits   = "reducer-limits"
+	argReducers        = "reducers"
+	argShell           = "shell"
+	argShowVersion     = "version"
+	argSummary         = "summary"
+	argStallTimeout    = "stall-timeout"
+	argStderrTail      = "stderr-tail"
+	argTempDir         = "tempdir"
+	argTrace           = "trace"
+	argWorkerTimeout   = "worker-timeout"
+	argWorkerLogs      = "worker-logs"
 )
 
 var (
 	// cli flag defaults
-	defaultMappers      = 1
-	defaultReducers     = 1
-	defaultMemoryString = "16m"
-	defaultTempDir      = os.TempDir()
+	defaultMappers         = 1
+	defaultReducers        = 1
+	defaultMemoryString    = "16m"
+	defaultTempDir         = os.TempDir()
+	defaultHeader          = headerAuto
+	defaultPrefix          = 8
+	defaultProgress        = 10 * time.Second
+	defaultRecordDelimiter = `\n`
+	defaultKeyDelimiter    = `\t`
+	defaultBadRecords      = badRecordsFail
+	defaultStderrTail      = 10
+	defaultLogFormat       = logFormatText
+	defaultLogLevel        = "info"
 
 	// set by ldflags at compile time
 	version = "unknown"
 
 	// set by cli flags
-	mappers      int
-	reducers     int
-	memoryString string
-	tempDir      string
-	input        string
-	mapper       string
-	output       string
-	profile      string
-	reducer      string
-	showVersion  bool
+	badRecordsString      string
+	cgroupParent          string
+	cgroupCPUs            float64
+	cgroupMemory          string
+	mappers               int
+	reducers              int
+	memoryString          string
+	chunkSizeString       string
+	assign                string
+	tempDir               string
+	traceFile             string
+	framed                bool
+	header                string
+	httpAddr              string
+	prefix                int
+	input                 patternList
+	inputList             string
+	exclude               patternList
+	includeHidden         bool
+	inputCmd              string
+	keyDelimiterString    string
+	jobDeadline           time.Duration
+	logFormat             string
+	logLevel              string
+	mapper                string
+	mapperLimit           string
+	output                string
+	profile               string
+	progressInterval      time.Duration
+	recordDelimiterString string
+	quiet                 bool
+	reducer               string
+	reducerLimit          string
+	shell                 bool
+	showVersion           bool
+	summary               string
+	stallTimeout          time.Duration
+	stderrTailLines       int
+	workerTimeout         time.Duration
+	workerLogs            string
 
 	// computed from cli flags
-	memory     int
-	tempSpill  string
-	tempOutput string
+	memory        int
+	mapperLimits  limits
+	reducerLimits limits
+	badRecords    badRecordPolicy
+	bufMem        int
+	bufferHeader  headerLayout
+	tempSpill     string
+	tempOutput    string
 
 	// inputChunks is a channel from which multiple mapper workers will pull input chunks.
 	inputChunks chan *chunk
@@ -85,20 +160,55 @@ var (
 )
 
 func init() {
-	flag.StringVar(&input, argInput, "", "")
+	flag.StringVar(&badRecordsString, argBadRecords, defaultBadRecords, "")
+	flag.StringVar(&cgroupParent, argCgroup, "", "")
+	flag.Float64Var(&cgroupCPUs, argCgroupCPUs, 0, "")
+	flag.StringVar(&cgroupMemory, argCgroupMemory, "", "")
+	flag.BoolVar(&framed, argFramed, false, "")
+	flag.StringVar(&header, argHeader, defaultHeader, "")
+	flag.StringVar(&httpAddr, argHTTP, "", "")
+	flag.Var(&input, argInput, "")
+	flag.StringVar(&inputList, argInputList, "", "")
+	flag.Var(&exclude, argExclude, "")
+	flag.BoolVar(&includeHidden, argIncludeHidden, false, "")
+	flag.StringVar(&inputCmd, argInputCmd, "", "")
+	flag.StringVar(&keyDelimiterString, argKeyDelimiter, defaultKeyDelimiter, "")
+	flag.DurationVar(&jobDeadline, argJobDeadline, 0, "")
+	flag.StringVar(&logFormat, argLogFormat, defaultLogFormat, "")
+	flag.StringVar(&logLevel, argLogLevel, defaultLogLevel, "")
 	flag.StringVar(&mapper, argMapper, "", "")
+	flag.StringVar(&mapperLimit, argMapperLimits, "", "")
 	flag.IntVar(&mappers, argMappers, defaultMappers, "")
 	flag.StringVar(&memoryString, argMemoryString, defaultMemoryString, "")
+	flag.StringVar(&chunkSizeString, argChunkSize, defaultChunkSize, "")
+	flag.StringVar(&assign, argAssign, defaultAssign, "")
 	flag.StringVar(&output, argOutput, "", "")
+	flag.IntVar(&prefix, argPrefix, defaultPrefix, "")
 	flag.StringVar(&profile, argProfile, "", "")
+	flag.DurationVar(&progressInterval, argProgress, defaultProgress, "")
+	flag.StringVar(&recordDelimiterString, argRecordDelimiter, defaultRecordDelimiter, "")
+	flag.BoolVar(&quiet, argQuiet, false, "")
 	flag.StringVar(&reducer, argReducer, "", "")
+	flag.StringVar(&reducerLimit, argReducerLimits, "", "")
 	flag.IntVar(&reducers, argReducers, defaultReducers, "")
+	flag.BoolVar(&shell, argShell, false, "")
 	flag.BoolVar(&showVersion, argShowVersion, false, "")
+	flag.StringVar(&summary, argSummary, "", "")
+	flag.DurationVar(&stallTimeout, argStallTimeout, 0, "")
+	flag.IntVar(&stderrTailLines, argStderrTail, defaultStderrTail, "")
 	flag.StringVar(&tempDir, argTempDir, defaultTempDir, "")
+	flag.StringVar(&traceFile, argTrace, "", "")
+	flag.DurationVar(&workerTimeout, argWorkerTimeout, 0, "")
+	flag.StringVar(&workerLogs, argWorkerLogs, "", "")
 	flag.Usage = usage
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == limitsHelperArg {
+		err := execLimited(os.Args[2:])
+		fmt.Fprintf(os.Stderr, "xrt: failed applying limits - %v\n", err)
+		os.Exit(126)
+	}
 	flag.Parse()
 	if len(os.Args) <= 1 {
 		usage()
@@ -126,14 +236,44 @@ func main() {
 
 func usage() {
 	fmt.Printf("usage: xrt [--help] [--%s] <options>\n", argShowVersion)
-	fmt.Printf(" --%s <input>   Input pattern, example: path/to/file_*.tsv\n", argInput)
-	fmt.Printf(" --%s <cmd>    Mapper command (required)\n", argMapper)
-	fmt.Printf(" --%s <num>   Number of mappers (default: %d)\n", argMappers, defaultMappers)
-	fmt.Printf(" --%s <mem>    Memory limit, example: 1k, 2m, 3g, 4t (default: %s)\n", argMemoryString, defaultMemoryString)
-	fmt.Printf(" --%s <dir>    Output directory, if not set any output will go to stdout\n", argOutput)
-	fmt.Printf(" --%s <cmd>   Reducer command, do not set for a map-only job\n", argReducer)
-	fmt.Printf(" --%s <num>  Number of reducers (default: %d)\n", argReducers, defaultReducers)
-	fmt.Printf(" --%s <dir>   Temporary directory (default: %s)\n", argTempDir, defaultTempDir)
+	fmt.Printf(" --%s <mode>             Chunk assignment: %s chunks as mappers become free, or deterministically %s or by %s (default: %s)\n", argAssign, assignPull, assignRoundRobin, assignFile, defaultAssign)
+	fmt.Printf(" --%s <policy>      Mapper output lines that cannot be partitioned: fail, skip or deadletter, optionally with a maximum, example: skip:100, deadletter:1%% (default: %s)\n", argBadRecords, defaultBadRecords)
+	fmt.Printf(" --%s <dir>              Create a cgroup v2 subtree for the job under this cgroup directory\n", argCgroup)
+	fmt.Printf(" --%s <num>         CPU budget of the job cgroup, example: 2.5\n", argCgroupCPUs)
+	fmt.Printf(" --%s <mem>       Memory budget of the job cgroup, covering xrt and all workers\n", argCgroupMemory)
+	fmt.Printf(" --%s <size>         Input chunk size, example: 64m, or %s to give every mapper about %d chunks of the input files (default: %s)\n", argChunkSize, chunkSizeAuto, chunksPerMapper, defaultChunkSize)
+	fmt.Printf(" --%s <pattern>         Skip input files matching this pattern, may be repeated, example: *.tmp\n", argExclude)
+	fmt.Printf(" --%s                    Exchange length prefixed binary records with workers and input files\n", argFramed)
+	fmt.Printf(" --%s <layout>           Record header layout: %s, %s or %s (default: %s)\n", argHeader, headerAuto, headerCompact, headerWide, defaultHeader)
+	fmt.Printf(" --%s <addr>               Serve metrics and pprof while running, example: :8080 or unix:/path/to.sock\n", argHTTP)
+	fmt.Printf(" --%s            Do not skip input files and directories whose name starts with . or _\n", argIncludeHidden)
+	fmt.Printf(" --%s <input>             Input pattern, may be repeated, example: path/to/file_*.tsv or logs/**/*.gz, or - to read stdin\n", argInput)
+	fmt.Printf(" --%s <cmd>           Command whose stdout is the input, instead of --%s\n", argInputCmd, argInput)
+	fmt.Printf(" --%s <file>         File listing input paths, one per line\n", argInputList)
+	fmt.Printf(" --%s <dur>        Abort the job if it runs longer than this, example: 2h\n", argJobDeadline)
+	fmt.Printf(" --%s <delim>     Delimiter between partition and record on mapper output (default: %s)\n", argKeyDelimiter, defaultKeyDelimiter)
+	fmt.Printf(" --%s <fmt>          Log format: %s or %s (default: %s)\n", argLogFormat, logFormatText, logFormatJSON, defaultLogFormat)
+	fmt.Printf(" --%s <lvl>           Minimum level of xrt and worker stderr log lines: debug, info, warn or error (default: %s)\n", argLogLevel, defaultLogLevel)
+	fmt.Printf(" --%s <cmd>              Mapper command (required)\n", argMapper)
+	fmt.Printf(" --%s <lim>       Mapper resource limits, example: as=2g,rss=1g,cpu=600,nofile=1024,nice=10,ionice=7,pin\n", argMapperLimits)
+	fmt.Printf(" --%s <num>             Number of mappers (default: %d)\n", argMappers, defaultMappers)
+	fmt.Printf(" --%s <mem>              Memory for sorting map output, split into mappers*reducers buffers of at least %db, example: 1k, 2m, 3g, 4t (default: %s)\n", argMemoryString, minBufMem, defaultMemoryString)
+	fmt.Printf(" --%s <dir>              Output directory, if not set any output will go to stdout\n", argOutput)
+	fmt.Printf(" --%s <num>              Inline record prefix in bytes for %s headers (default: %d)\n", argPrefix, headerCompact, defaultPrefix)
+	fmt.Printf(" --%s <dur>            Progress interval when stderr is not a terminal, 0 disables progress (default: %s)\n", argProgress, defaultProgress)
+	fmt.Printf(" --%s                     Do not log the banner and every processed input chunk\n", argQuiet)
+	fmt.Printf(" --%s <delim>  Record delimiter, a character or \\n, \\t, \\0 or \\r\\n (default: %s)\n", argRecordDelimiter, defaultRecordDelimiter)
+	fmt.Printf(" --%s <cmd>             Reducer command, do not set for a map-only job\n", argReducer)
+	fmt.Printf(" --%s <lim>      Reducer resource limits, same format as --%s\n", argReducerLimits, argMapperLimits)
+	fmt.Printf(" --%s <num>            Number of reducers (default: %d)\n", argReducers, defaultReducers)
+	fmt.Printf(" --%s                     Run the mapper and reducer commands with %s -c\n", argShell, shellPath)
+	fmt.Printf(" --%s <dur>       Fail a worker if no data moves through its stdin or stdout for this long\n", argStallTimeout)
+	fmt.Printf(" --%s <num>         Lines of worker stderr kept for errors and --%s (default: %d)\n", argStderrTail, argWorkerLogs, defaultStderrTail)
+	fmt.Printf(" --%s <file>            Write a JSON summary of the job, its configuration and counters\n", argSummary)
+	fmt.Printf(" --%s <dir>             Temporary directory (default: %s)\n", argTempDir, defaultTempDir)
+	fmt.Printf(" --%s <file>              Write a Chrome trace event timeline of the job\n", argTrace)
+	fmt.Printf(" --%s <dir>         Write the stderr of every worker to its own file in this directory, example: logs\n", argWorkerLogs)
+	fmt.Printf(" --%s <dur>      Fail a worker if it runs longer than this, example: 30m\n", argWorkerTimeout)
 }
 
 func setup() (err error) {
@@ -143,15 +283,150 @@ func setup() (err error) {
 	if !hasMapper() {
 		return fmt.Errorf("xrt: --%s is required", argMapper)
 	}
+	if _, err := commandArgs(mapper); err != nil {
+		return fmt.Errorf("xrt: invalid argument --%s=%s - %v", argMapper, mapper, err)
+	}
+	if mapperLimits, err = parseLimits(mapperLimit); err != nil {
+		return fmt.Errorf("xrt: invalid argument --%s=%s - %v", argMapperLimits, mapperLimit, err)
+	}
+	if hasInputCmd() {
+		if len(input) > 0 || hasInputList() {
+			return fmt.Errorf("xrt: --%s and --%s can not be used with --%s", argInput, argInputList, argInputCmd)
+		}
+		if _, err := commandArgs(inputCmd); err != nil {
+			return fmt.Errorf("xrt: invalid argument --%s=%s - %v", argInputCmd, inputCmd, err)
+		}
+	}
 	if hasReducer() && reducers <= 0 {
 		return fmt.Errorf("xrt: invalid argument --%s=%d", argReducers, reducers)
 	}
+	if hasReducer() {
+		if _, err := commandArgs(reducer); err != nil {
+			return fmt.Errorf("xrt: invalid argument --%s=%s - %v", argReducer, reducer, err)
+		}
+		if reducerLimits, err = parseLimits(reducerLimit); err != nil {
+			return fmt.Errorf("xrt: invalid argument --%s=%s - %v", argReducerLimits, reducerLimit, err)
+		}
+	}
+	recordDelim, err := parseDelimiter(recordDelimiterString)
+	if err != nil {
+		return fmt.Errorf("xrt: invalid argument --%s=%s - %v", argRecordDelimiter, recordDelimiterString, err)
+	}
+	keyDelim, err := parseDelimiter(keyDelimiterString)
+	if err != nil || len(keyDelim) != 1 {
+		return fmt.Errorf("xrt: invalid argument --%s=%s - a single character is required", argKeyDelimiter, keyDelimiterString)
+	}
+	if bytes.IndexByte(recordDelim, keyDelim[0]) >= 0 {
+		return fmt.Errorf("xrt: --%s and --%s must differ", argRecordDelimiter, argKeyDelimiter)
+	}
+	setDelimiters(recordDelim, keyDelim[0])
+	if framed && (recordDelimiterString != defaultRecordDelimiter || keyDelimiterString != defaultKeyDelimiter) {
+		return fmt.Errorf("xrt: --%s and --%s can not be used with --%s", argRecordDelimiter, argKeyDelimiter, argFramed)
+	}
+	if badRecords, err = parseBadRecords(badRecordsString); err != nil {
+		return fmt.Errorf("xrt: invalid argument --%s=%s - %v", argBadRecords, badRecordsString, err)
+	}
+	if badRecords.action == badRecordsDeadLetter && !hasOutput() {
+		return fmt.Errorf("xrt: --%s=%s requires --%s", argBadRecords, badRecordsString, argOutput)
+	}
+	if jobDeadline < 0 {
+		return fmt.Errorf("xrt: invalid argument --%s=%s", argJobDeadline, jobDeadline)
+	}
+	if workerTimeout < 0 {
+		return fmt.Errorf("xrt: invalid argument --%s=%s", argWorkerTimeout, workerTimeout)
+	}
+	if progressInterval < 0 {
+		return fmt.Errorf("xrt: invalid argument --%s=%s", argProgress, progressInterval)
+	}
+	if logFormat != logFormatText && logFormat != logFormatJSON {
+		return fmt.Errorf("xrt: invalid argument --%s=%s", argLogFormat, logFormat)
+	}
+	level, ok := parseLevel(logLevel)
+	if !ok {
+		return fmt.Errorf("xrt: invalid argument --%s=%s", argLogLevel, logLevel)
+	}
+	logLevelThreshold = level
+	setupLog()
+	if stderrTailLines < 0 {
+		return fmt.Errorf("xrt: invalid argument --%s=%d", argStderrTail, stderrTailLines)
+	}
+	if stallTimeout < 0 {
+		return fmt.Errorf("xrt: invalid argument --%s=%s", argStallTimeout, stallTimeout)
+	}
 	if memory = parseMemory(memoryString); memory < 0 {
 		return fmt.Errorf("xrt: invalid argument --%s=%s", argMemoryString, memoryString)
 	}
+	switch assign {
+	case assignPull, assignRoundRobin, assignFile:
+	default:
+		return fmt.Errorf("xrt: invalid argument --%s=%s", argAssign, assign)
+	}
+	if chunkSizeString == chunkSizeAuto && !hasInputFiles() {
+		return fmt.Errorf("xrt: --%s=%s requires input files", argChunkSize, chunkSizeAuto)
+	}
+	if chunkSizeString != chunkSizeAuto {
+		size := parseMemory(chunkSizeString)
+		if size <= 0 {
+			return fmt.Errorf("xrt: invalid argument --%s=%s", argChunkSize, chunkSizeString)
+		}
+		chunkSize = int64(size)
+	}
+	if hasReducer() {
+		bufMem = memory / (mappers * reducers)
+		if bufMem < minBufMem {
+			return fmt.Errorf(
+				"xrt: --%s=%s leaves less than %db per buffer for %d mappers and %d reducers",
+				argMemoryString,
+				memoryString,
+				minBufMem,
+				mappers,
+				reducers,
+			)
+		}
+	}
+	if header != headerCompact && isSet(argPrefix) {
+		return fmt.Errorf("xrt: --%s requires --%s=%s", argPrefix, argHeader, headerCompact)
+	}
+	switch header {
+	case headerAuto:
+	case headerWide:
+		bufferHeader = wideLayout
+	case headerCompact:
+		if prefix < 0 || maxPrefix < prefix {
+			return fmt.Errorf("xrt: invalid argument --%s=%d", argPrefix, prefix)
+		}
+		if uint64(bufMem) > math.MaxUint32 {
+			return fmt.Errorf("xrt: --%s=%s requires less than 4g of memory per buffer", argHeader, header)
+		}
+		bufferHeader = compactLayout(prefix)
+	default:
+		return fmt.Errorf("xrt: invalid argument --%s=%s", argHeader, header)
+	}
 	if tempDir, err = ioutil.TempDir(tempDir, "xrt-"); err != nil {
 		return fmt.Errorf("xrt: failed initializing directory '%s' - %v", tempDir, err)
 	}
+	if hasCgroup() {
+		budget := 0
+		if cgroupMemory != "" {
+			if budget = parseMemory(cgroupMemory); budget <= 0 {
+				return fmt.Errorf("xrt: invalid argument --%s=%s", argCgroupMemory, cgroupMemory)
+			}
+		}
+		if cgroupCPUs < 0 {
+			return fmt.Errorf("xrt: invalid argument --%s=%g", argCgroupCPUs, cgroupCPUs)
+		}
+		if err = setupCgroup(cgroupParent, budget, cgroupCPUs); err != nil {
+			return fmt.Errorf("xrt: failed creating job cgroup in %s - %v", cgroupParent, err)
+		}
+		// main exits without cleaning up when setup fails, so remove the job cgroup here
+		defer func() {
+			if err != nil {
+				cleanupCgroup()
+			}
+		}()
+	} else if cgroupMemory != "" || cgroupCPUs != 0 {
+		return fmt.Errorf("xrt: --%s and --%s require --%s", argCgroupMemory, argCgroupCPUs, argCgroup)
+	}
 	tempOutput = path.Join(tempDir, "output")
 	if err = os.Mkdir(tempOutput, 0700); err != nil {
 		return fmt.Errorf("xrt: failed initializing directory '%s' - %v", tempOutput, err)
@@ -163,15 +438,39 @@ func setup() (err error) {
 	if _, err := os.Stat(output); hasOutput() && err == nil {
 		return fmt.Errorf("xrt: --%s directory %s already exists", argOutput, output)
 	}
-	if hasInput() {
-		if inputChunks, err = enumerateChunks(input); err != nil {
+	if hasInputCmd() {
+		inputChunks = make(chan *chunk)
+	} else if hasInput() {
+		if inputChunks, err = enumerateChunks(input, inputList, exclude); err != nil {
 			return fmt.Errorf("parsing --%s failed with error: %v", argInput, err)
 		}
 	}
+	if assign == assignFile && !hasInputFiles() {
+		return fmt.Errorf("xrt: --%s=%s requires input files", argAssign, assignFile)
+	}
+	setupAssign()
+	setupStats()
+	setupProgress()
+	if err = setupWorkerLogs(); err != nil {
+		return fmt.Errorf("xrt: failed initializing directory '%s' - %v", workerLogs, err)
+	}
 	if hasReducer() {
 		buffers = make([][]*buffer, mappers)
 		for i := range buffers {
 			buffers[i] = make([]*buffer, reducers)
+			for j := range buffers[i] {
+				spillDir := path.Join(tempSpill, strconv.Itoa(i), strconv.Itoa(j))
+				b := newBuffer(bufMem, spillDir, bufferHeader)
+				b.stats = &mapStats[i].Partitions[j]
+				b.state = &mapStates[i]
+				b.mapper, b.reducer = i, j
+				buffers[i][j] = b
+			}
+		}
+	}
+	if hasHTTP() {
+		if err := startHTTP(httpAddr); err != nil {
+			return fmt.Errorf("xrt: failed serving --%s=%s - %v", argHTTP, httpAddr, err)
 		}
 	}
 	return nil
@@ -184,6 +483,9 @@ func setup() (err error) {
 //    parseMemory("1k") = 1048576
 // -1 is returned if a bad memory string was provided.
 func parseMemory(v string) int {
+	if v == "" {
+		return -1
+	}
 	var m uint
 	switch v[len(v)-1] {
 	case 'b':
@@ -208,109 +510,212 @@ func parseMemory(v string) int {
 	return n << m
 }
 
+// formatMemory is the inverse of parseMemory, it formats a number of bytes using the largest unit
+// that represents it exactly.
+func formatMemory(n int) string {
+	units := "bkmgtp"
+	i := 0
+	for i < len(units)-1 && n != 0 && n%1024 == 0 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%d%c", n, units[i])
+}
+
 func run() {
 	startInterruptHandler()
-	log.Print("")
-	log.Print("                                                 tttt")
-	log.Print("                                              ttt:::t")
-	log.Print("                                              t:::::t")
-	log.Print("                                              t:::::t")
-	log.Print("xxxxxxx      xxxxxxxrrrrr   rrrrrrrrr   ttttttt:::::ttttttt")
-	log.Print(" x:::::x    x:::::x r::::rrr:::::::::r  t:::::::::::::::::t")
-	log.Print("  x:::::x  x:::::x  r:::::::::::::::::r t:::::::::::::::::t")
-	log.Print("   x:::::xx:::::x   rr::::::rrrrr::::::rtttttt:::::::tttttt")
-	log.Print("    x::::::::::x     r:::::r     r:::::r      t:::::t")
-	log.Print("     x::::::::x      r:::::r     rrrrrrr      t:::::t")
-	log.Print("     x::::::::x      r:::::r                  t:::::t")
-	log.Print("    x::::::::::x     r:::::r                  t:::::t    tttttt")
-	log.Print("   x:::::xx:::::x    r:::::r                  t::::::tttt:::::t")
-	log.Print("  x:::::x  x:::::x   r:::::r                  tt::::::::::::::t")
-	log.Print(" x:::::x    x:::::x  r:::::r                    tt:::::::::::tt")
-	log.Print("xxxxxxx      xxxxxxx rrrrrrr                      ttttttttttt")
-	log.Print("")
-	log.Print("===============================================================")
-	log.Printf("version: %s", version)
-	log.Print("===============================================================")
-	log.Print("")
-	log.Print("configuration:")
-	log.Print("")
-	log.Printf("  mappers: %d", mappers)
+	if jobDeadline > 0 {
+		time.AfterFunc(jobDeadline-time.Since(startTime), func() {
+			rollback(fmt.Errorf("job deadline of %s exceeded - aborting job", jobDeadline))
+		})
+	}
+	logBanner()
+	infof("config", "configuration:")
+	infof("config", "")
+	infof("config", "  mappers: %d", mappers)
+	if hasReducer() {
+		infof("config", "  reducers: %d", reducers)
+	}
+	infof("config", "  memory: %s", memoryString)
+	if chunkSizeString == chunkSizeAuto {
+		infof("config", "  chunk size: %s (%s)", formatBytes(chunkSize), chunkSizeAuto)
+	} else {
+		infof("config", "  chunk size: %s", chunkSizeString)
+	}
+	if assign != assignPull {
+		infof("config", "  chunk assignment: %s", assign)
+	}
+	if framed {
+		infof("config", "  framed records: varint length prefix")
+	}
+	if recordDelimiterString != defaultRecordDelimiter {
+		infof("config", "  record delimiter: %s", recordDelimiterString)
+	}
+	if hasReducer() && keyDelimiterString != defaultKeyDelimiter {
+		infof("config", "  key delimiter: %s", keyDelimiterString)
+	}
+	if mapperLimit != "" {
+		infof("config", "  mapper limits: %s", mapperLimit)
+	}
+	if hasReducer() && reducerLimit != "" {
+		infof("config", "  reducer limits: %s", reducerLimit)
+	}
+	if shell {
+		infof("config", "  shell: %s", shellPath)
+	}
 	if hasReducer() {
-		log.Printf("  reducers: %d", reducers)
+		if bufferHeader == (headerLayout{}) {
+			infof("config", "  record headers: auto, starting with %s", autoLayout(bufMem, 0, 0))
+		} else {
+			infof("config", "  record headers: %s", bufferHeader)
+		}
+		if badRecords.action != badRecordsFail {
+			infof("config", "  bad records: %s", badRecordsString)
+		}
+	}
+	infof("config", "  temporary directory: %s", tempDir)
+	if hasHTTP() {
+		infof("config", "  http: %s", httpListener.Addr())
+	}
+	if jobDeadline > 0 {
+		infof("config", "  job deadline: %s", jobDeadline)
+	}
+	if workerTimeout > 0 {
+		infof("config", "  worker timeout: %s", workerTimeout)
+	}
+	if stallTimeout > 0 {
+		infof("config", "  stall timeout: %s", stallTimeout)
+	}
+	if hasWorkerLogs() {
+		infof("config", "  worker logs: %s", workerLogs)
 	}
-	log.Printf("  memory: %s", memoryString)
-	log.Printf("  temporary directory: %s", tempDir)
-	log.Print("")
-	log.Print("plan:")
-	log.Print("")
+	if hasCgroup() {
+		infof("config", "  cgroup: %s", jobCgroup)
+		if cgroupMemory != "" {
+			infof("config", "  cgroup memory: %s", cgroupMemory)
+		}
+		if cgroupCPUs > 0 {
+			infof("config", "  cgroup cpus: %g", cgroupCPUs)
+		}
+	}
+	infof("config", "")
+	infof("plan", "plan:")
+	infof("plan", "")
 	indent := "  "
 	if hasOutput() {
-		log.Printf("%s->  output (%s)", indent, output)
+		infof("plan", "%s->  output (%s)", indent, output)
 		indent = indent + "  "
 	}
 	if hasReducer() {
-		log.Printf("%s->  reduce (%s)", indent, reducer)
+		infof("plan", "%s->  reduce (%s)", indent, reducer)
 		indent = indent + "  "
-		log.Printf("%s->  partition and sort", indent)
+		infof("plan", "%s->  partition and sort", indent)
 		indent = indent + "  "
 	}
-	log.Printf("%s->  map (%s)", indent, mapper)
-	if hasInput() {
-		log.Printf("%s  ->  input (%s)", indent, input)
+	infof("plan", "%s->  map (%s)", indent, mapper)
+	if hasInputCmd() {
+		infof("plan", "%s  ->  input command (%s)", indent, inputCmd)
+	} else if hasInputFiles() {
+		infof("plan", "%s  ->  input (%s) - %d files, %s", indent, inputDescription(), len(inputFiles), formatBytes(inputTotal))
+		if len(inputFiles) == 0 {
+			warnf("plan", "%s     no input files matched", indent)
+		}
+	} else if hasInput() {
+		infof("plan", "%s  ->  input (%s)", indent, input.String())
+	}
+	infof("plan", "")
+	infof("stage", "running mapper stage")
+	infof("stage", "")
+	if progressInterval > 0 {
+		startProgress()
+	}
+	setStage(stageMap)
+	if hasInputCmd() {
+		go startInputCmd(inputCmd, inputChunks)
+	}
+	if hasInput() && mapperChunks != nil {
+		go startAssign(inputChunks)
 	}
-	log.Print("")
-	log.Print("running mapper stage")
-	log.Print("")
 	startTimeMappers := time.Now()
-	if err := runMany(mappers, mapWorker); err != nil {
+	endTrace := traceSpan("", 0, "map stage", nil)
+	if err := runMany(stageMap, mappers, mapWorker); err != nil {
 		rollback(err)
 	}
-	durationMappers := time.Since(startTimeMappers)
-	log.Print("")
-	var durationReducers time.Duration
+	endTrace()
+	durationMappers = time.Since(startTimeMappers)
+	if err := checkBadRecords(); err != nil {
+		rollback(err)
+	}
+	infof("stage", "")
 	if hasReducer() {
-		log.Print("running reducer stage")
-		log.Print("")
+		infof("stage", "running reducer stage")
+		infof("stage", "")
+		setStage(stageReduce)
 		startTimeReducers := time.Now()
-		if err := runMany(reducers, reduceWorker); err != nil {
+		endTrace := traceSpan("", 0, "reduce stage", nil)
+		if err := runMany(stageReduce, reducers, reduceWorker); err != nil {
 			rollback(err)
 		}
+		endTrace()
 		durationReducers = time.Since(startTimeReducers)
-		log.Print("")
+		infof("stage", "")
 	}
+	stopProgress()
 	if hasOutput() {
-		log.Print("committing")
-		log.Print("")
+		infof("commit", "committing")
+		infof("commit", "")
+		endTrace := traceSpan("", 0, "commit", nil)
 		commit()
+		endTrace()
+	}
+	infof("stats", "  mappers runtime: %s", durationMappers.String())
+	if hasReducer() {
+		infof("stats", "  reducers runtime: %s", durationReducers.String())
 	}
-	log.Printf("  mappers runtime: %s", durationMappers.String())
+	infof("stats", "  total runtime: %s", time.Since(startTime).String())
+	logStats()
+	if hasInputCmd() {
+		logUsage(stageInput, inputStats)
+	}
+	logUsage(stageMap, mapStats)
+	logBottleneck(stageMap, mapStats)
 	if hasReducer() {
-		log.Printf("  reducers runtime: %s", durationReducers.String())
+		logUsage(stageReduce, reduceStats)
+		logBottleneck(stageReduce, reduceStats)
+	}
+	logCounters()
+	if hasCgroup() {
+		logCgroupUsage()
+	}
+	if hasSummary() {
+		writeSummary(nil)
+	}
+	if hasTrace() {
+		writeTrace()
 	}
-	log.Printf("  total runtime: %s", time.Since(startTime).String())
-	log.Print("")
-	log.Print("success")
+	infof("success", "")
+	infof("success", "success")
 	if !hasOutput() {
 		printOutput()
 	}
 	cleanup()
 }
 
-// startInterruptHandler launches a handler that will catch the first interrupt signal and attempt
-// a graceful termination (mainly to deal with ctrl-c)
+// startInterruptHandler launches a handler that will catch the first interrupt, terminate or hangup
+// signal and attempt a graceful termination (mainly to deal with ctrl-c)
 func startInterruptHandler() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, interruptSignals...)
 	go func() {
-		<-c
-		rollback(errors.New("received interrupt - aborting job"))
+		sig := <-c
+		rollback(fmt.Errorf("received %v - aborting job", sig))
 	}()
 }
 
-func runMany(workers int, worker func(context) error) error {
+func runMany(stage string, workers int, worker func(context) error) error {
 	errc := make(chan error)
 	for i := 0; i < workers; i++ {
-		go func(wid int) { errc <- worker(context{wid, mappers, reducers}) }(i)
+		go func(wid int) { errc <- worker(context{stage, wid, mappers, reducers}) }(i)
 	}
 	for i := 0; i < workers; i++ {
 		if err := <-errc; err != nil {
@@ -323,20 +728,19 @@ func runMany(workers int, worker func(context) error) error {
 func mapWorker(c context) error {
 	c.log("mapper starting")
 	defer c.log("done")
-	if hasReducer() {
-		bufMem := memory / (mappers * reducers)
-		for i := range buffers[c.workerID] {
-			spillDir := path.Join(tempSpill, strconv.Itoa(c.workerID), strconv.Itoa(i))
-			buffers[c.workerID][i] = newBuffer(bufMem, spillDir)
-		}
-	}
+	c.setState(stateRunning)
+	defer c.setState(stateDone)
 	if err := c.exec(mapper, mapStdinHandler, mapStdoutHandler, logStream); err != nil {
 		return err
 	}
 	if hasReducer() {
 		c.log("sorting")
-		for _, b := range buffers[c.workerID] {
+		for i, b := range buffers[c.workerID] {
+			c.setState(stateSorting)
+			endTrace := c.traceSpan("sort", map[string]interface{}{"reducer": i, "records": b.Len()})
 			b.sort()
+			endTrace()
+			c.setState(stateMerging)
 			if err := b.externalSort(); err != nil {
 				return err
 			}
@@ -347,7 +751,7 @@ func mapWorker(c context) error {
 
 func mapStdinHandler(c context, w io.WriteCloser) error {
 	if hasInput() {
-		return inputStream(c, w, inputChunks)
+		return inputStream(c, w, c.chunks())
 	}
 	return w.Close()
 }
@@ -362,6 +766,8 @@ func mapStdoutHandler(c context, r io.ReadCloser) error {
 func reduceWorker(c context) error {
 	c.log("reducer starting")
 	defer c.log("done")
+	c.setState(stateRunning)
+	defer c.setState(stateDone)
 	return c.exec(reducer, reduceStdinHandler, reduceStdoutHandler, logStream)
 }
 
@@ -381,24 +787,66 @@ func reduceStdoutHandler(c context, r io.ReadCloser) error {
 // commands, ensures no more are spawned and removes any temorary data.
 func rollback(err error) {
 	rollbackOnce.Do(func() {
-		log.Print("error - attempting rollback")
-		log.Print("")
-		log.Print(err)
+		errorf("rollback", "error - attempting rollback")
+		errorf("rollback", "")
+		errorf("rollback", "%v", err)
+		stopProgress()
 		killAll()
+		closeWorkerLogs()
+		if hasSummary() {
+			writeSummary(err)
+		}
+		if hasTrace() {
+			writeTrace()
+		}
 		cleanup()
-		log.Print("failed")
+		errorf("failed", "failed")
 		os.Exit(1)
 	})
 }
 
+// logBanner logs the xrt banner and version, unless --quiet is set. JSON output only logs the
+// version.
+func logBanner() {
+	if logFormat == logFormatJSON {
+		infof("start", "xrt version %s", version)
+		return
+	}
+	if quiet {
+		return
+	}
+	infof("banner", "")
+	infof("banner", "                                                 tttt")
+	infof("banner", "                                              ttt:::t")
+	infof("banner", "                                              t:::::t")
+	infof("banner", "                                              t:::::t")
+	infof("banner", "xxxxxxx      xxxxxxxrrrrr   rrrrrrrrr   ttttttt:::::ttttttt")
+	infof("banner", " x:::::x    x:::::x r::::rrr:::::::::r  t:::::::::::::::::t")
+	infof("banner", "  x:::::x  x:::::x  r:::::::::::::::::r t:::::::::::::::::t")
+	infof("banner", "   x:::::xx:::::x   rr::::::rrrrr::::::rtttttt:::::::tttttt")
+	infof("banner", "    x::::::::::x     r:::::r     r:::::r      t:::::t")
+	infof("banner", "     x::::::::x      r:::::r     rrrrrrr      t:::::t")
+	infof("banner", "     x::::::::x      r:::::r                  t:::::t")
+	infof("banner", "    x::::::::::x     r:::::r                  t:::::t    tttttt")
+	infof("banner", "   x:::::xx:::::x    r:::::r                  t::::::tttt:::::t")
+	infof("banner", "  x:::::x  x:::::x   r:::::r                  tt::::::::::::::t")
+	infof("banner", " x:::::x    x:::::x  r:::::r                    tt:::::::::::tt")
+	infof("banner", "xxxxxxx      xxxxxxx rrrrrrr                      ttttttttttt")
+	infof("banner", "")
+	infof("banner", "===============================================================")
+	infof("banner", "version: %s", version)
+	infof("banner", "===============================================================")
+	infof("banner", "")
+}
+
 // commit ensures transactional termination of succesfull jobs. If the job is configured to create
 // output commit uses a directory move to transactioanlly "commit" the output from a temporary
 // folder to the final output folder.
 func commit() {
 	if err := os.Rename(tempOutput, output); err != nil {
-		log.Printf("  error moving output data from %s to %s - %v", tempOutput, output, err)
-		log.Printf("  temporary data directory %s was not removed", tempDir)
-		log.Print("failed")
+		errorf("commit", "  error moving output data from %s to %s - %v", tempOutput, output, err)
+		errorf("commit", "  temporary data directory %s was not removed", tempDir)
+		errorf("commit", "failed")
 		os.Exit(1)
 	}
 }
@@ -408,38 +856,96 @@ func commit() {
 func printOutput() {
 	files, err := ioutil.ReadDir(tempOutput)
 	if err != nil {
-		log.Printf("  error reading output data in %s - %v", tempOutput, err)
+		errorf("output", "  error reading output data in %s - %v", tempOutput, err)
 		os.Exit(1)
 	}
 	for _, file := range files {
 		filename := path.Join(tempOutput, file.Name())
 		f, err := os.Open(filename)
 		if err != nil {
-			log.Printf("  error reading output data in %s - %v", filename, err)
+			errorf("output", "  error reading output data in %s - %v", filename, err)
 			os.Exit(1)
 		}
 		r := bufio.NewReader(f)
 		w := bufio.NewWriter(os.Stdout)
 		if _, err := io.Copy(w, r); err != nil {
-			log.Printf("  error copying output data in %s to stdout - %v", filename, err)
+			errorf("output", "  error copying output data in %s to stdout - %v", filename, err)
 		}
 		if err := w.Flush(); err != nil {
-			log.Printf("  error copying output data in %s to stdout - %v", filename, err)
+			errorf("output", "  error copying output data in %s to stdout - %v", filename, err)
 		}
 	}
 }
 
 // cleanup removes any remaining temporary files.
 func cleanup() {
+	stopHTTP()
 	// BUG this will break on windows since it does not allow removal of open files and by the
 	// time this is called it is possible fds in the tempdir are still open.
 	if err := os.RemoveAll(tempDir); err != nil {
-		log.Printf("  failed to remove temporary data directory %s - %v", tempDir, err)
+		warnf("cleanup", "  failed to remove temporary data directory %s - %v", tempDir, err)
+	}
+	if err := cleanupCgroup(); err != nil {
+		warnf("cleanup", "  failed to remove job cgroup %s - %v", jobCgroup, err)
 	}
 }
 
+// isSet reports whether the flag name was given on the command line.
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func hasCgroup() bool {
+	return len(cgroupParent) > 0
+}
+
+func hasHTTP() bool {
+	return len(httpAddr) > 0
+}
+
 func hasInput() bool {
-	return len(input) > 0
+	return len(input) > 0 || hasInputList() || hasInputCmd()
+}
+
+func hasInputList() bool {
+	return len(inputList) > 0
+}
+
+// hasStdinInput returns true if the input is read from stdin, which is the case when - is the only
+// input.
+func hasStdinInput() bool {
+	return len(input) == 1 && input[0] == stdinInput && !hasInputList()
+}
+
+// hasInputFiles returns true if the input is read from files rather than stdin or a command, even
+// when no files matched.
+func hasInputFiles() bool {
+	return (len(input) > 0 || hasInputList()) && !hasStdinInput() && !hasInputCmd()
+}
+
+// inputDescription describes the input patterns, list and excludes for the plan.
+func inputDescription() string {
+	parts := []string{}
+	if len(input) > 0 {
+		parts = append(parts, input.String())
+	}
+	if hasInputList() {
+		parts = append(parts, fmt.Sprintf("list %s", inputList))
+	}
+	if len(exclude) > 0 {
+		parts = append(parts, fmt.Sprintf("excluding %s", exclude.String()))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func hasInputCmd() bool {
+	return len(inputCmd) > 0
 }
 
 func hasMapper() bool {
@@ -450,6 +956,18 @@ func hasReducer() bool {
 	return len(reducer) > 0
 }
 
+func hasSummary() bool {
+	return len(summary) > 0
+}
+
+func hasTrace() bool {
+	return len(traceFile) > 0
+}
+
+func hasWorkerLogs() bool {
+	return len(workerLogs) > 0
+}
+
 func hasOutput() bool {
 	return len(output) > 0
 }
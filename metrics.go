@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// httpListener serves the --http endpoint while the job is running.
+var httpListener net.Listener
+
+// startHTTP starts serving prometheus metrics on /metrics and the pprof handlers on /debug/pprof/
+// at addr, which is either a tcp address such as :8080 or a unix socket given as unix:<path>.
+func startHTTP(addr string) error {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network = "unix"
+		addr = addr[len("unix:"):]
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	httpListener = l
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go http.Serve(l, mux)
+	return nil
+}
+
+// stopHTTP stops serving the --http endpoint, which also removes its unix socket.
+func stopHTTP() {
+	if httpListener != nil {
+		httpListener.Close()
+	}
+}
+
+// serveMetrics writes the job metrics in the prometheus text exposition format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := metricsWriter{w: w}
+	m.metric("xrt_uptime_seconds", "gauge", "Time since the job started.")
+	m.value("", time.Since(startTime).Seconds())
+	if hasInput() {
+		m.metric("xrt_input_found_bytes", "gauge", "Input bytes found so far.")
+		m.value("", atomic.LoadInt64(&inputTotal))
+		m.metric("xrt_input_walk_done", "gauge", "Whether all input has been found.")
+		m.value("", atomic.LoadInt32(&walkDone))
+	}
+	stages := []struct {
+		name   string
+		stats  []workerStats
+		states []int32
+	}{
+		{stageMap, mapStats, mapStates},
+		{stageReduce, reduceStats, reduceStates},
+	}
+	metrics := []struct {
+		name  string
+		help  string
+		value func(s *workerStats) *int64
+	}{
+		{"xrt_worker_input_bytes_total", "Bytes fed to the worker.", func(s *workerStats) *int64 { return &s.InputBytes }},
+		{"xrt_worker_input_records_total", "Records fed to the worker.", func(s *workerStats) *int64 { return &s.InputRecords }},
+		{"xrt_worker_output_bytes_total", "Bytes written by the worker.", func(s *workerStats) *int64 { return &s.OutputBytes }},
+		{"xrt_worker_output_records_total", "Records written by the worker.", func(s *workerStats) *int64 { return &s.OutputRecords }},
+	}
+	for _, metric := range metrics {
+		m.metric(metric.name, "counter", metric.help)
+		for _, stage := range stages {
+			for i := range stage.stats {
+				m.value(fmt.Sprintf(`stage="%s",worker="%d"`, stage.name, i), atomic.LoadInt64(metric.value(&stage.stats[i])))
+			}
+		}
+	}
+	m.metric("xrt_worker_state", "gauge", "Current state of the worker, 1 for the active state.")
+	for _, stage := range stages {
+		for i := range stage.states {
+			state := atomic.LoadInt32(&stage.states[i])
+			for j, name := range stateNames {
+				v := 0
+				if int32(j) == state {
+					v = 1
+				}
+				m.value(fmt.Sprintf(`stage="%s",worker="%d",state="%s"`, stage.name, i, name), v)
+			}
+		}
+	}
+	if hasReducer() {
+		m.metric("xrt_spills_total", "counter", "Spills of the buffer of a mapper for a reducer.")
+		m.partitions(func(p *partitionStats) int64 { return atomic.LoadInt64(&p.Spills) })
+		m.metric("xrt_spill_bytes_total", "counter", "Bytes spilled by the buffer of a mapper for a reducer.")
+		m.partitions(func(p *partitionStats) int64 { return atomic.LoadInt64(&p.SpillBytes) })
+		m.metric("xrt_buffer_fill_ratio", "gauge", "Fraction of the buffer of a mapper for a reducer in use.")
+		for i := range buffers {
+			for j := range buffers[i] {
+				if b := buffers[i][j]; b != nil && len(b.buf) > 0 {
+					m.value(fmt.Sprintf(`mapper="%d",reducer="%d"`, i, j), float64(atomic.LoadInt64(&b.fill))/float64(len(b.buf)))
+				}
+			}
+		}
+	}
+	countersMu.Lock()
+	if len(counters) > 0 {
+		m.metric("xrt_counter", "counter", "Counters reported by workers.")
+		for _, k := range sortedCounters() {
+			m.value(fmt.Sprintf(`group="%s",name="%s"`, escapeLabel(k.group), escapeLabel(k.name)), counters[k])
+		}
+	}
+	countersMu.Unlock()
+}
+
+type metricsWriter struct {
+	w    io.Writer
+	name string
+}
+
+func (m *metricsWriter) metric(name, kind, help string) {
+	m.name = name
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m *metricsWriter) value(labels string, v interface{}) {
+	if labels == "" {
+		fmt.Fprintf(m.w, "%s %v\n", m.name, v)
+		return
+	}
+	fmt.Fprintf(m.w, "%s{%s} %v\n", m.name, labels, v)
+}
+
+func (m *metricsWriter) partitions(v func(p *partitionStats) int64) {
+	for i := range mapStats {
+		for j := range mapStats[i].Partitions {
+			m.value(fmt.Sprintf(`mapper="%d",reducer="%d"`, i, j), v(&mapStats[i].Partitions[j]))
+		}
+	}
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
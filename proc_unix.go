@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// interruptSignals are the signals that make xrt abort a running job.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// sysProcAttr starts every worker as the leader of a new process group so that any processes it
+// spawns can be signalled together with it.
+func sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateGroup asks every process in the group led by pid to terminate.
+func terminateGroup(pid int) {
+	syscall.Kill(-pid, syscall.SIGTERM)
+}
+
+// killGroup forcefully kills every process in the group led by pid.
+func killGroup(pid int) {
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// groupExists reports whether any process, including unreaped ones, remains in the group led by
+// pid.
+func groupExists(pid int) bool {
+	return syscall.Kill(-pid, 0) != syscall.ESRCH
+}
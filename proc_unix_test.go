@@ -0,0 +1,41 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestPruneGroups(t *testing.T) {
+	// the worker exits right away and leaves a grandchild behind in its process group
+	cmd := exec.Command("sh", "-c", "sleep 0.2 & exit 0")
+	cmd.SysProcAttr = sysProcAttr()
+	if err := start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	if err := wait(cmd); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	tracked := groups[pid]
+	mu.Unlock()
+	if !tracked {
+		t.Fatalf("group %d was pruned while the grandchild is running", pid)
+	}
+	for deadline := time.Now().Add(5 * time.Second); liveGroups() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("group %d still live after the grandchild exited", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	tracked = groups[pid]
+	mu.Unlock()
+	if tracked {
+		t.Errorf("group %d is still tracked after it became empty", pid)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// interruptSignals are the signals that make xrt abort a running job.
+var interruptSignals = []os.Signal{os.Interrupt}
+
+// sysProcAttr returns the default process attributes, process groups are not used on windows so
+// only the worker process itself is signalled.
+func sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// terminateGroup kills the process pid since windows does not support graceful termination.
+func terminateGroup(pid int) {
+	killGroup(pid)
+}
+
+// killGroup kills the process pid.
+func killGroup(pid int) {
+	if p, err := os.FindProcess(pid); err == nil {
+		p.Kill()
+	}
+}
+
+// stillActive is the exit code GetExitCodeProcess reports for a process that is still running.
+const stillActive = 259
+
+// groupExists reports whether the process pid is still running. A process that has exited but
+// whose handle is still open can be found, so its exit code is checked as well.
+func groupExists(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressRefresh is how often the progress display is redrawn when stderr is a terminal.
+const progressRefresh = 250 * time.Millisecond
+
+// maxProgressStatuses is the maximum number of worker status messages shown in the progress
+// display.
+const maxProgressStatuses = 8
+
+// worker states shown in the progress display
+const (
+	statePending int32 = iota
+	stateRunning
+	stateSpilling
+	stateSorting
+	stateMerging
+	stateDone
+)
+
+var stateNames = []string{"pending", "running", "spilling", "sorting", "merging", "done"}
+
+var (
+	// inputTotal is the number of input bytes found so far, walkDone is set once all input has
+	// been found and inputTotal is final.
+	inputTotal int64
+	walkDone   int32
+
+	// mapStates and reduceStates hold the current state of every mapper and reducer.
+	mapStates    []int32
+	reduceStates []int32
+
+	// currentStage is the stage currently running and stageStart the time it started.
+	stageMu      sync.Mutex
+	currentStage string
+	stageStart   time.Time
+
+	// stopProgress stops the progress reporting started by startProgress.
+	stopProgress = func() {}
+)
+
+// setupProgress allocates the worker states.
+func setupProgress() {
+	mapStates = make([]int32, mappers)
+	if hasReducer() {
+		reduceStates = make([]int32, reducers)
+	}
+}
+
+// setStage marks the start of a stage.
+func setStage(s string) {
+	stageMu.Lock()
+	currentStage, stageStart = s, time.Now()
+	stageMu.Unlock()
+}
+
+// setState updates the state of the worker shown in the progress display.
+func (c context) setState(state int32) {
+	switch c.stage {
+	case stageInput:
+	case stageReduce:
+		atomic.StoreInt32(&reduceStates[c.workerID], state)
+	default:
+		atomic.StoreInt32(&mapStates[c.workerID], state)
+	}
+}
+
+// startProgress starts reporting progress, as a refreshing display if stderr is a terminal or
+// as a log line every --progress interval otherwise or with json logs, until stopProgress is called.
+func startProgress() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	if isTerminal(os.Stderr) && logFormat == logFormatText {
+		t := &progressTerminal{w: os.Stderr}
+		log.SetOutput(t)
+		go func() {
+			defer close(stopped)
+			tick := time.NewTicker(progressRefresh)
+			defer tick.Stop()
+			for {
+				select {
+				case <-done:
+					t.clear()
+					log.SetOutput(os.Stderr)
+					return
+				case <-tick.C:
+					t.redraw()
+				}
+			}
+		}()
+	} else {
+		go func() {
+			defer close(stopped)
+			tick := time.NewTicker(progressInterval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-tick.C:
+					infof("progress", "  progress: %s", strings.Join(progressLines(), ", "))
+				}
+			}
+		}()
+	}
+	var once sync.Once
+	stopProgress = func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progressTerminal is the log output used while the progress display is shown on a terminal. It
+// keeps the display below the log lines by erasing it before, and redrawing it after, every write.
+type progressTerminal struct {
+	mu    sync.Mutex
+	w     io.Writer
+	lines int
+}
+
+func (t *progressTerminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.erase()
+	n, err := t.w.Write(p)
+	t.draw()
+	return n, err
+}
+
+func (t *progressTerminal) redraw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.erase()
+	t.draw()
+}
+
+func (t *progressTerminal) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.erase()
+}
+
+func (t *progressTerminal) erase() {
+	t.w.Write(bytes.Repeat([]byte("\033[1A\033[2K"), t.lines))
+	t.lines = 0
+}
+
+func (t *progressTerminal) draw() {
+	lines := progressLines()
+	t.w.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	t.lines = len(lines)
+}
+
+// progressLines describes the progress of the job, one line per aspect.
+func progressLines() []string {
+	stageMu.Lock()
+	s, start := currentStage, stageStart
+	stageMu.Unlock()
+	lines := []string{}
+	m := totalStats(mapStats)
+	if hasInput() {
+		total := atomic.LoadInt64(&inputTotal)
+		line := fmt.Sprintf("input: %s", formatBytes(m.InputBytes))
+		if atomic.LoadInt32(&walkDone) == 1 {
+			line = fmt.Sprintf("%s / %s (%s)", line, formatBytes(total), percent(m.InputBytes, total))
+			if s == stageMap {
+				line = fmt.Sprintf("%s, eta %s", line, eta(start, m.InputBytes, total))
+			}
+		} else {
+			line = fmt.Sprintf("%s / %s+", line, formatBytes(total))
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf("map: %s", describeStates(mapStates)))
+	if hasReducer() {
+		spills := int64(0)
+		for _, p := range m.Partitions {
+			spills += p.Spills
+		}
+		lines[len(lines)-1] += fmt.Sprintf(", %d spills", spills)
+		line := fmt.Sprintf("reduce: %s", describeStates(reduceStates))
+		if s == stageReduce {
+			r := totalStats(reduceStats)
+			line = fmt.Sprintf(
+				"%s, %s of records, eta %s",
+				line,
+				percent(r.InputRecords, m.OutputRecords),
+				eta(start, r.InputRecords, m.OutputRecords),
+			)
+		}
+		lines = append(lines, line)
+	}
+	countersMu.Lock()
+	workers := make([]string, 0, len(statuses))
+	for w := range statuses {
+		workers = append(workers, w)
+	}
+	sort.Strings(workers)
+	for i, w := range workers {
+		if i == maxProgressStatuses {
+			lines = append(lines, fmt.Sprintf("... %d more statuses", len(workers)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", w, statuses[w]))
+	}
+	countersMu.Unlock()
+	return lines
+}
+
+// describeStates counts the workers in each state, for example "2 running, 1 sorting, 1 done".
+func describeStates(states []int32) string {
+	counts := make([]int, len(stateNames))
+	for i := range states {
+		counts[atomic.LoadInt32(&states[i])]++
+	}
+	parts := []string{}
+	for state, n := range counts {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, stateNames[state]))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func percent(n, total int64) string {
+	if total <= 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%d%%", 100*n/total)
+}
+
+// eta estimates the remaining time of a stage that started at start and has processed n out of
+// total units so far.
+func eta(start time.Time, n, total int64) string {
+	if n <= 0 || total <= n {
+		return "n/a"
+	}
+	elapsed := time.Since(start)
+	remaining := time.Duration(float64(elapsed) * float64(total-n) / float64(n))
+	return remaining.Round(time.Second).String()
+}
+
+// formatBytes formats a number of bytes with one decimal in the largest fitting unit.
+func formatBytes(n int64) string {
+	units := "bkmgtp"
+	f := float64(n)
+	i := 0
+	for i < len(units)-1 && f >= 1024 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%c", n, units[0])
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
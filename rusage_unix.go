@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// processUsage returns the peak resident set size and the bytes read and written of an exited
+// process, or -1 for values that are not available.
+func processUsage(s *os.ProcessState) (maxRSS, readBytes, writeBytes int64) {
+	ru, ok := s.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return -1, -1, -1
+	}
+	maxRSS = int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		// ru_maxrss is reported in kilobytes everywhere but on darwin
+		maxRSS *= 1024
+	}
+	// block counts are in units of 512 bytes
+	return maxRSS, int64(ru.Inblock) * 512, int64(ru.Oublock) * 512
+}
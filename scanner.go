@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
@@ -27,20 +28,7 @@ func (s *memoryScanner) next() bool {
 	s.lst, s.nxt = s.nxt, s.lst
 	s.index++
 	if s.index < s.buf.Len() {
-		n := readInt(s.buf.buf, s.index*32)
-		if n > cap(s.nxt) {
-			s.nxt = make([]byte, 4096*(n%4096)+4096)
-		}
-		s.nxt = s.nxt[:n]
-		pn := 16
-		if n < pn {
-			pn = n
-		}
-		copy(s.nxt[0:pn], s.buf.buf[s.index*32+8:s.index*32+8+pn])
-		if n > 16 {
-			p := readInt(s.buf.buf, s.index*32+24)
-			copy(s.nxt[16:n], s.buf.buf[p:p+n-16])
-		}
+		s.nxt = s.buf.record(s.index, s.nxt)
 		return true
 	}
 	return false
@@ -136,21 +124,19 @@ func newFileScanner(filename string) *fileScanner {
 }
 
 // readVarInt reads a variable length integer from a read buffer. This function will return a
-// io.EOF iff the read of the first byte of the varint results in a io.EOF.
+// io.EOF iff the read of the first byte of the varint results in a io.EOF. Varints longer than
+// binary.MaxVarintLen64 bytes or that do not fit in an int are rejected.
 func readVarInt(r *bufio.Reader) (int, error) {
-	n := 0
-	for i := 0; ; i++ {
-		b, err := r.ReadByte()
-		if err != nil {
-			if i == 0 && err == io.EOF {
-				return -1, err
-			}
-			return -1, fmt.Errorf("error reading varint byte: %v", err)
-		}
-		n |= int(b&0x7F) << uint(7*i)
-		if b&0x80 == 0 {
-			break
+	x, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return -1, err
 		}
+		return -1, fmt.Errorf("error reading varint byte: %v", err)
+	}
+	n := int(x)
+	if n < 0 || uint64(n) != x {
+		return -1, fmt.Errorf("varint %d overflows int", x)
 	}
 	return n, nil
 }
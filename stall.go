@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stream tracks when bytes last moved through a worker stdin or stdout pipe, whether the pipe has
+// been closed and whether xrt itself is waiting for data to move through it, which is used to
+// detect stalled workers. It also accumulates the time spent blocked in reads or writes on the
+// pipe, which is used to find the bottleneck of a stage.
+type stream struct {
+	name    string
+	last    int64 // unix nanoseconds of the last read or write
+	blocked int64 // nanoseconds spent in reads or writes
+	done    int32
+	waiting int32
+}
+
+func newStream(name string) *stream {
+	return &stream{name: name, last: time.Now().UnixNano()}
+}
+
+func (s *stream) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+func (s *stream) finish() {
+	atomic.StoreInt32(&s.done, 1)
+}
+
+// wait marks the stream as waiting on xrt, for example for the next input chunk, until the
+// returned function is called. A worker is not stalled while xrt keeps it waiting.
+func (s *stream) wait() func() {
+	atomic.AddInt32(&s.waiting, 1)
+	return func() {
+		s.touch()
+		atomic.AddInt32(&s.waiting, -1)
+	}
+}
+
+// waitOn marks the stream of a worker pipe handed to a handler as waiting on xrt, see stream.wait.
+// Pipes without a stream are ignored.
+func waitOn(pipe interface{}) func() {
+	if p, ok := pipe.(interface{ stream() *stream }); ok {
+		return p.stream().wait()
+	}
+	return func() {}
+}
+
+// idle returns how long the stream has gone without moving any bytes, or zero once it is closed.
+func (s *stream) idle(now time.Time) time.Duration {
+	if atomic.LoadInt32(&s.done) == 1 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&s.last)))
+}
+
+type streamWriter struct {
+	io.WriteCloser
+	s *stream
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.WriteCloser.Write(p)
+	atomic.AddInt64(&w.s.blocked, int64(time.Since(start)))
+	if n > 0 {
+		w.s.touch()
+	}
+	return n, err
+}
+
+func (w streamWriter) stream() *stream {
+	return w.s
+}
+
+func (w streamWriter) Close() error {
+	w.s.finish()
+	return w.WriteCloser.Close()
+}
+
+type streamReader struct {
+	io.ReadCloser
+	s *stream
+}
+
+func (r streamReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.s.blocked, int64(time.Since(start)))
+	if n > 0 {
+		r.s.touch()
+	}
+	if err != nil {
+		r.s.finish()
+	}
+	return n, err
+}
+
+func (r streamReader) stream() *stream {
+	return r.s
+}
+
+// stalled returns an error naming the open streams if none of them has moved any bytes for at
+// least timeout and xrt is not keeping any of them waiting, otherwise it returns nil.
+func stalled(timeout time.Duration, streams ...*stream) error {
+	now := time.Now()
+	names := []string{}
+	for _, s := range streams {
+		if atomic.LoadInt32(&s.waiting) > 0 {
+			return nil
+		}
+	}
+	for _, s := range streams {
+		idle := s.idle(now)
+		if idle == 0 {
+			continue
+		}
+		if idle < timeout {
+			return nil
+		}
+		names = append(names, s.name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return fmt.Errorf("stalled - no data moved through %s for %s", strings.Join(names, " or "), timeout)
+}
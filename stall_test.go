@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStalled(t *testing.T) {
+	stdin, stdout := newStream("stdin"), newStream("stdout")
+	time.Sleep(20 * time.Millisecond)
+	if err := stalled(10*time.Millisecond, stdin, stdout); err == nil {
+		t.Errorf("stalled => nil, want an error for idle streams")
+	}
+	done := stdin.wait()
+	if err := stalled(10*time.Millisecond, stdin, stdout); err != nil {
+		t.Errorf("stalled => %v, want nil while xrt keeps stdin waiting", err)
+	}
+	done()
+	if err := stalled(10*time.Millisecond, stdin, stdout); err != nil {
+		t.Errorf("stalled => %v, want nil right after stdin stopped waiting", err)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSpillNotStalled(t *testing.T) {
+	defer func(m int) { memory = m }(memory)
+	memory = 4 << 20
+	dir, err := ioutil.TempDir("", "xrt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the spill blocks writing to the fifo until the test reads it
+	fifo := path.Join(dir, "spill-0")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	stdout := newStream("stdout")
+	r := streamReader{ioutil.NopCloser(strings.NewReader("")), stdout}
+	b := newBuffer(64, dir, wideLayout)
+	record := bytes.Repeat([]byte{'a'}, 1<<20)
+	errc := make(chan error)
+	go func() { errc <- addRecord(r, b, record) }()
+	f, err := os.Open(fifo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	time.Sleep(20 * time.Millisecond)
+	if err := stalled(10*time.Millisecond, stdout); err != nil {
+		t.Errorf("stalled => %v, want nil while the buffer spills", err)
+	}
+	if _, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("addRecord returned error %v", err)
+	}
+	if b.spills != 1 {
+		t.Errorf("addRecord => %d spills, want 1", b.spills)
+	}
+}
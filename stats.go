@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workerStats are the built-in counters of a single mapper or reducer. For mappers the input is
+// the data read from the input chunks and the output is the data written by the mapper process,
+// for reducers the input is the merged data fed to the reducer process. Counters are updated
+// atomically since they can be read while the job is running.
+type workerStats struct {
+	InputBytes    int64            `json:"input_bytes"`
+	InputRecords  int64            `json:"input_records"`
+	OutputBytes   int64            `json:"output_bytes"`
+	OutputRecords int64            `json:"output_records"`
+	BadRecords    int64            `json:"bad_records,omitempty"`
+	Partitions    []partitionStats `json:"partitions,omitempty"`
+	Usage         workerUsage      `json:"usage"`
+	Pipes         pipeStats        `json:"pipes"`
+
+	// The counters are updated atomically, which on 32-bit platforms needs them 64-bit aligned in
+	// every element of a []workerStats. This rounds the three word Partitions slice header up so
+	// that the size of workerStats is a multiple of 8 bytes there as well.
+	_ uintptr
+}
+
+// partitionStats are the counters of a single mapper buffer, that is the output of a mapper for a
+// single reducer.
+type partitionStats struct {
+	Records     int64 `json:"records"`
+	Bytes       int64 `json:"bytes"`
+	Spills      int64 `json:"spills"`
+	SpillBytes  int64 `json:"spill_bytes"`
+	MergePasses int64 `json:"merge_passes"`
+}
+
+var (
+	inputStats  []workerStats
+	mapStats    []workerStats
+	reduceStats []workerStats
+
+	// statsMu guards the Usage and Pipes of every worker, which are stored when a worker exits and
+	// can be read by a rollback while other workers are still running.
+	statsMu sync.Mutex
+
+	// durationMappers and durationReducers are the runtimes of the mapper and reducer stages.
+	durationMappers  time.Duration
+	durationReducers time.Duration
+)
+
+// setupStats allocates the counters for all mappers and reducers.
+func setupStats() {
+	if hasInputCmd() {
+		inputStats = make([]workerStats, 1)
+	}
+	mapStats = make([]workerStats, mappers)
+	if hasReducer() {
+		for i := range mapStats {
+			mapStats[i].Partitions = make([]partitionStats, reducers)
+		}
+		reduceStats = make([]workerStats, reducers)
+	}
+}
+
+// stats returns the counters of the worker.
+func (c context) stats() *workerStats {
+	switch c.stage {
+	case stageInput:
+		return &inputStats[c.workerID]
+	case stageReduce:
+		return &reduceStats[c.workerID]
+	}
+	return &mapStats[c.workerID]
+}
+
+// countingWriter counts the bytes and records written through it. Records are counted by their
+// delimiters, or by their framing with --framed.
+type countingWriter struct {
+	w       io.Writer
+	bytes   *int64
+	records *int64
+	frames  *frameCounter
+}
+
+func newCountingWriter(w io.Writer, bytes, records *int64) countingWriter {
+	cw := countingWriter{w: w, bytes: bytes, records: records}
+	if framed {
+		cw.frames = &frameCounter{}
+	}
+	return cw
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.bytes, int64(n))
+	if w.frames != nil {
+		atomic.AddInt64(w.records, w.frames.count(p[:n]))
+	} else {
+		atomic.AddInt64(w.records, int64(bytes.Count(p[:n], []byte{recordDelimiter})))
+	}
+	return n, err
+}
+
+// totalStats sums the counters of all workers in a stage.
+func totalStats(stats []workerStats) workerStats {
+	t := workerStats{}
+	for i := range stats {
+		t.InputBytes += atomic.LoadInt64(&stats[i].InputBytes)
+		t.InputRecords += atomic.LoadInt64(&stats[i].InputRecords)
+		t.OutputBytes += atomic.LoadInt64(&stats[i].OutputBytes)
+		t.OutputRecords += atomic.LoadInt64(&stats[i].OutputRecords)
+		t.BadRecords += atomic.LoadInt64(&stats[i].BadRecords)
+		for j := range stats[i].Partitions {
+			if len(t.Partitions) <= j {
+				t.Partitions = append(t.Partitions, partitionStats{})
+			}
+			p := &stats[i].Partitions[j]
+			t.Partitions[j].Records += atomic.LoadInt64(&p.Records)
+			t.Partitions[j].Bytes += atomic.LoadInt64(&p.Bytes)
+			t.Partitions[j].Spills += atomic.LoadInt64(&p.Spills)
+			t.Partitions[j].SpillBytes += atomic.LoadInt64(&p.SpillBytes)
+			t.Partitions[j].MergePasses += atomic.LoadInt64(&p.MergePasses)
+		}
+	}
+	return t
+}
+
+// snapshotStats returns a copy of the counters of all workers in a stage that is safe to read while
+// the workers are still running.
+func snapshotStats(stats []workerStats) []workerStats {
+	s := make([]workerStats, len(stats))
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	for i := range stats {
+		s[i] = workerStats{
+			InputBytes:    atomic.LoadInt64(&stats[i].InputBytes),
+			InputRecords:  atomic.LoadInt64(&stats[i].InputRecords),
+			OutputBytes:   atomic.LoadInt64(&stats[i].OutputBytes),
+			OutputRecords: atomic.LoadInt64(&stats[i].OutputRecords),
+			BadRecords:    atomic.LoadInt64(&stats[i].BadRecords),
+			Usage:         stats[i].Usage,
+			Pipes:         stats[i].Pipes,
+		}
+		if stats[i].Partitions != nil {
+			s[i].Partitions = make([]partitionStats, len(stats[i].Partitions))
+		}
+		for j := range stats[i].Partitions {
+			p := &stats[i].Partitions[j]
+			s[i].Partitions[j] = partitionStats{
+				Records:     atomic.LoadInt64(&p.Records),
+				Bytes:       atomic.LoadInt64(&p.Bytes),
+				Spills:      atomic.LoadInt64(&p.Spills),
+				SpillBytes:  atomic.LoadInt64(&p.SpillBytes),
+				MergePasses: atomic.LoadInt64(&p.MergePasses),
+			}
+		}
+	}
+	return s
+}
+
+// logStats logs the totals of the built-in counters.
+func logStats() {
+	m := totalStats(mapStats)
+	infof("stats", "  input: %d records, %d bytes", m.InputRecords, m.InputBytes)
+	infof("stats", "  map output: %d records, %d bytes", m.OutputRecords, m.OutputBytes)
+	if hasReducer() {
+		spills, spillBytes := int64(0), int64(0)
+		for _, p := range m.Partitions {
+			spills += p.Spills
+			spillBytes += p.SpillBytes
+		}
+		infof("stats", "  spills: %d, %d bytes", spills, spillBytes)
+		if m.BadRecords > 0 {
+			infof("stats", "  bad records: %d (%s)", m.BadRecords, badRecordsString)
+		}
+		r := totalStats(reduceStats)
+		infof("stats", "  reduce output: %d records, %d bytes", r.OutputRecords, r.OutputBytes)
+	}
+}
+
+// jobSummary is the machine readable summary of a job written to the --summary file.
+type jobSummary struct {
+	Version  string                      `json:"version"`
+	Status   string                      `json:"status"`
+	Error    string                      `json:"error,omitempty"`
+	Config   summaryConfig               `json:"config"`
+	Timings  summaryTimings              `json:"timings"`
+	Input    *summaryStage               `json:"input,omitempty"`
+	Map      summaryStage                `json:"map"`
+	Reduce   *summaryStage               `json:"reduce,omitempty"`
+	Counters map[string]map[string]int64 `json:"counters"`
+	Cgroup   *summaryCgroup              `json:"cgroup,omitempty"`
+}
+
+type summaryConfig struct {
+	Input      []string `json:"input,omitempty"`
+	InputList  string   `json:"input_list,omitempty"`
+	Exclude    []string `json:"exclude,omitempty"`
+	InputFiles int      `json:"input_files,omitempty"`
+	InputBytes int64    `json:"input_bytes,omitempty"`
+	InputCmd   string   `json:"input_cmd,omitempty"`
+	Output     string   `json:"output,omitempty"`
+	Mapper     string   `json:"mapper"`
+	Mappers    int      `json:"mappers"`
+	Reducer    string   `json:"reducer,omitempty"`
+	Reducers   int      `json:"reducers,omitempty"`
+	Memory     int      `json:"memory"`
+	ChunkSize  int64    `json:"chunk_size"`
+	Assign     string   `json:"assign"`
+	TempDir    string   `json:"tempdir"`
+	WorkerLogs string   `json:"worker_logs,omitempty"`
+	BadRecords string   `json:"bad_records,omitempty"`
+}
+
+// summaryTimings are given in seconds.
+type summaryTimings struct {
+	Start    time.Time `json:"start"`
+	Mappers  float64   `json:"mappers"`
+	Reducers float64   `json:"reducers,omitempty"`
+	Total    float64   `json:"total"`
+}
+
+type summaryStage struct {
+	Total      workerStats   `json:"total"`
+	Bottleneck *bottleneck   `json:"bottleneck,omitempty"`
+	Workers    []workerStats `json:"workers"`
+}
+
+// newSummaryStage summarizes a snapshot of the counters of a stage, the bottleneck is only analyzed
+// once the job is done.
+func newSummaryStage(stage string, stats []workerStats, done bool) summaryStage {
+	stats = snapshotStats(stats)
+	total := totalStats(stats)
+	total.Usage = totalUsage(stats)
+	s := summaryStage{Total: total, Workers: stats}
+	if done {
+		b := analyzeBottleneck(stage, stats)
+		s.Bottleneck = &b
+		s.Total.Pipes = b.Pipes
+	}
+	return s
+}
+
+type summaryCgroup struct {
+	Job     summaryUsage   `json:"job"`
+	Workers []summaryUsage `json:"workers"`
+}
+
+// summaryUsage is the cgroup usage of the job or a worker, unknown values are -1.
+type summaryUsage struct {
+	Stage      string  `json:"stage,omitempty"`
+	Worker     int     `json:"worker"`
+	CPU        float64 `json:"cpu"`
+	MemoryPeak int     `json:"memory_peak"`
+}
+
+func newSummaryUsage(stage string, workerID int, u cgroupUsage) summaryUsage {
+	cpu := -1.0
+	if u.cpu >= 0 {
+		cpu = u.cpu.Seconds()
+	}
+	return summaryUsage{stage, workerID, cpu, u.memoryPeak}
+}
+
+// writeSummary writes the job summary to the --summary file, err is the error that failed the job
+// or nil if it succeeded.
+func writeSummary(err error) {
+	s := jobSummary{
+		Version: version,
+		Status:  "success",
+		Config: summaryConfig{
+			Input:      input,
+			InputList:  inputList,
+			Exclude:    exclude,
+			InputFiles: len(inputFiles),
+			InputBytes: inputSize(inputFiles),
+			InputCmd:   inputCmd,
+			Output:     output,
+			Mapper:     mapper,
+			Mappers:    mappers,
+			Memory:     memory,
+			ChunkSize:  chunkSize,
+			Assign:     assign,
+			TempDir:    tempDir,
+			WorkerLogs: workerLogs,
+		},
+		Timings: summaryTimings{
+			Start:    startTime,
+			Mappers:  durationMappers.Seconds(),
+			Reducers: durationReducers.Seconds(),
+			Total:    time.Since(startTime).Seconds(),
+		},
+		Map:      newSummaryStage(stageMap, mapStats, err == nil),
+		Counters: make(map[string]map[string]int64),
+	}
+	if err != nil {
+		s.Status = "failed"
+		s.Error = err.Error()
+	}
+	if hasInputCmd() {
+		in := newSummaryStage(stageInput, inputStats, false)
+		s.Input = &in
+	}
+	if hasReducer() {
+		s.Config.Reducer = reducer
+		s.Config.Reducers = reducers
+		s.Config.BadRecords = badRecordsString
+		reduce := newSummaryStage(stageReduce, reduceStats, err == nil)
+		s.Reduce = &reduce
+	}
+	countersMu.Lock()
+	for k, n := range counters {
+		if s.Counters[k.group] == nil {
+			s.Counters[k.group] = make(map[string]int64)
+		}
+		s.Counters[k.group][k.name] = n
+	}
+	countersMu.Unlock()
+	if hasCgroup() {
+		s.Cgroup = &summaryCgroup{Job: newSummaryUsage("", 0, jobCgroupUsage())}
+		cgroupUsageMu.Lock()
+		for _, u := range workerUsages {
+			s.Cgroup.Workers = append(s.Cgroup.Workers, newSummaryUsage(u.stage, u.workerID, u.usage))
+		}
+		cgroupUsageMu.Unlock()
+	}
+	b, e := json.MarshalIndent(s, "", "  ")
+	if e == nil {
+		e = ioutil.WriteFile(summary, append(b, '\n'), 0644)
+	}
+	if e != nil {
+		warnf("summary", "  failed writing job summary to %s - %v", summary, e)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// trace process ids, each stage gets its own process in the trace with a thread per worker
+const (
+	tracePidJob = iota
+	tracePidMap
+	tracePidReduce
+)
+
+// traceEvent is a single event in the Chrome trace event format, see
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+var (
+	traceMu     sync.Mutex
+	traceEvents []traceEvent
+)
+
+// micros returns the time since the start of the job in microseconds.
+func micros(t time.Time) float64 {
+	return float64(t.Sub(startTime).Nanoseconds()) / 1000
+}
+
+// traceSpan starts a span on the track of worker in stage, an empty stage selects the job track.
+// The returned function ends the span.
+func traceSpan(stage string, worker int, name string, args map[string]interface{}) func() {
+	if !hasTrace() {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		e := traceEvent{
+			Name: name,
+			Ph:   "X",
+			Ts:   micros(start),
+			Dur:  micros(time.Now()) - micros(start),
+			Pid:  tracePid(stage),
+			Tid:  worker,
+			Args: args,
+		}
+		traceMu.Lock()
+		traceEvents = append(traceEvents, e)
+		traceMu.Unlock()
+	}
+}
+
+// traceSpan starts a span on the track of the worker.
+func (c context) traceSpan(name string, args map[string]interface{}) func() {
+	return traceSpan(c.stage, c.workerID, name, args)
+}
+
+func tracePid(stage string) int {
+	switch stage {
+	case stageMap:
+		return tracePidMap
+	case stageReduce:
+		return tracePidReduce
+	}
+	return tracePidJob
+}
+
+// writeTrace writes all traced events to the --trace file together with the metadata naming the
+// tracks.
+func writeTrace() {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	events := []traceEvent{
+		traceMetadata("process_name", tracePidJob, 0, "xrt"),
+		traceMetadata("process_name", tracePidMap, 0, "mappers"),
+		traceMetadata("process_name", tracePidReduce, 0, "reducers"),
+	}
+	for i := 0; i < mappers; i++ {
+		events = append(events, traceMetadata("thread_name", tracePidMap, i, fmt.Sprintf("mapper %d", i)))
+	}
+	for i := 0; hasReducer() && i < reducers; i++ {
+		events = append(events, traceMetadata("thread_name", tracePidReduce, i, fmt.Sprintf("reducer %d", i)))
+	}
+	events = append(events, traceEvents...)
+	b, err := json.Marshal(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+	if err == nil {
+		err = ioutil.WriteFile(traceFile, b, 0644)
+	}
+	if err != nil {
+		warnf("trace", "  failed writing trace to %s - %v", traceFile, err)
+	}
+}
+
+func traceMetadata(name string, pid, tid int, value string) traceEvent {
+	return traceEvent{
+		Name: name,
+		Ph:   "M",
+		Pid:  pid,
+		Tid:  tid,
+		Args: map[string]interface{}{"name": value},
+	}
+}
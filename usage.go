@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// outlierFactor is how many times slower than the median of its stage a worker has to be, in
+// runtime or cpu time, to be flagged as an outlier.
+const outlierFactor = 3
+
+// minOutlierWorkers is the smallest number of workers in a stage for outliers to be flagged.
+const minOutlierWorkers = 3
+
+// workerUsage is the resource usage of a worker process. Times are given in seconds and values
+// that are not available on the platform are -1.
+type workerUsage struct {
+	Runtime    float64 `json:"runtime"`
+	UserCPU    float64 `json:"user_cpu"`
+	SystemCPU  float64 `json:"system_cpu"`
+	MaxRSS     int64   `json:"max_rss"`
+	ReadBytes  int64   `json:"read_bytes"`
+	WriteBytes int64   `json:"write_bytes"`
+}
+
+func (u workerUsage) cpu() float64 {
+	return u.UserCPU + u.SystemCPU
+}
+
+func (u workerUsage) String() string {
+	return fmt.Sprintf(
+		"runtime %s, user %s, sys %s, max rss %s, read %s, write %s",
+		seconds(u.Runtime),
+		seconds(u.UserCPU),
+		seconds(u.SystemCPU),
+		optionalBytes(u.MaxRSS),
+		optionalBytes(u.ReadBytes),
+		optionalBytes(u.WriteBytes),
+	)
+}
+
+// recordUsage stores the resource usage of the exited worker process.
+func (c context) recordUsage(state *os.ProcessState, runtime time.Duration) {
+	u := workerUsage{
+		Runtime:   runtime.Seconds(),
+		UserCPU:   state.UserTime().Seconds(),
+		SystemCPU: state.SystemTime().Seconds(),
+	}
+	u.MaxRSS, u.ReadBytes, u.WriteBytes = processUsage(state)
+	statsMu.Lock()
+	c.stats().Usage = u
+	statsMu.Unlock()
+}
+
+// totalUsage aggregates the usage of all workers in a stage. Times and io are summed while the
+// runtime and max rss are the maximum of any worker. Values that are not available for a worker
+// are skipped and only reported as not available when no worker has them.
+func totalUsage(stats []workerStats) workerUsage {
+	t := workerUsage{MaxRSS: -1, ReadBytes: -1, WriteBytes: -1}
+	for i := range stats {
+		u := stats[i].Usage
+		if u.Runtime > t.Runtime {
+			t.Runtime = u.Runtime
+		}
+		if u.MaxRSS > t.MaxRSS {
+			t.MaxRSS = u.MaxRSS
+		}
+		t.UserCPU += u.UserCPU
+		t.SystemCPU += u.SystemCPU
+		addOptional(&t.ReadBytes, u.ReadBytes)
+		addOptional(&t.WriteBytes, u.WriteBytes)
+	}
+	return t
+}
+
+// addOptional adds n to the total t unless n is not available, a total that is not available yet
+// starts at n.
+func addOptional(t *int64, n int64) {
+	if n < 0 {
+		return
+	}
+	if *t < 0 {
+		*t = 0
+	}
+	*t += n
+}
+
+// logUsage logs the resource usage of a stage and of each of its workers, flagging workers that
+// are much slower than the median of the stage.
+func logUsage(stage string, stats []workerStats) {
+	infof("usage", "  %s usage: %s", stage, totalUsage(stats))
+	runtimes := make([]float64, len(stats))
+	cpus := make([]float64, len(stats))
+	for i := range stats {
+		runtimes[i] = stats[i].Usage.Runtime
+		cpus[i] = stats[i].Usage.cpu()
+	}
+	medianRuntime, medianCPU := median(runtimes), median(cpus)
+	for i := range stats {
+		u := stats[i].Usage
+		note := ""
+		if len(stats) >= minOutlierWorkers {
+			if medianRuntime > 0 && u.Runtime > outlierFactor*medianRuntime {
+				note = fmt.Sprintf(" <- outlier, runtime %.1fx the median", u.Runtime/medianRuntime)
+			} else if medianCPU > 0 && u.cpu() > outlierFactor*medianCPU {
+				note = fmt.Sprintf(" <- outlier, cpu time %.1fx the median", u.cpu()/medianCPU)
+			}
+		}
+		level := levelInfo
+		if note != "" {
+			level = levelWarn
+		}
+		logEvent(level, "", 0, "usage", fmt.Sprintf("    %s.%d: %s%s", stage, i, u, note))
+	}
+}
+
+func median(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	s := append([]float64{}, v...)
+	sort.Float64s(s)
+	if len(s)%2 == 0 {
+		return (s[len(s)/2-1] + s[len(s)/2]) / 2
+	}
+	return s[len(s)/2]
+}
+
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+func optionalBytes(n int64) string {
+	if n < 0 {
+		return "n/a"
+	}
+	return formatBytes(n)
+}
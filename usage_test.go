@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestTotalUsage(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		rss  []int64
+		io   []int64
+		out  int64
+		sum  int64
+	}{
+		{"all known", []int64{10, 30, 20}, []int64{1, 2, 3}, 30, 6},
+		{"unknown first", []int64{-1, 30, 20}, []int64{-1, 2, 3}, 30, 5},
+		{"unknown last", []int64{10, 30, -1}, []int64{1, 2, -1}, 30, 3},
+		{"all unknown", []int64{-1, -1}, []int64{-1, -1}, -1, -1},
+		{"no workers", nil, nil, -1, -1},
+	} {
+		stats := make([]workerStats, len(tt.rss))
+		for i := range stats {
+			stats[i].Usage = workerUsage{MaxRSS: tt.rss[i], ReadBytes: tt.io[i], WriteBytes: tt.io[i]}
+		}
+		u := totalUsage(stats)
+		if u.MaxRSS != tt.out {
+			t.Errorf("totalUsage(%s) => max rss %d, want %d", tt.name, u.MaxRSS, tt.out)
+		}
+		if u.ReadBytes != tt.sum || u.WriteBytes != tt.sum {
+			t.Errorf("totalUsage(%s) => read %d write %d, want %d", tt.name, u.ReadBytes, u.WriteBytes, tt.sum)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// stderrTail keeps the last lines a worker wrote to stderr, which are added to the error of a
+// failing worker and logged in place of the full stderr when --worker-logs is set.
+type stderrTail struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	total int
+}
+
+func newStderrTail(n int) *stderrTail {
+	return &stderrTail{lines: make([]string, n)}
+}
+
+func (t *stderrTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total++
+	if len(t.lines) == 0 {
+		return
+	}
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+}
+
+// last returns the kept lines, oldest first.
+func (t *stderrTail) last() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.total
+	if n > len(t.lines) {
+		n = len(t.lines)
+	}
+	lines := make([]string, 0, n)
+	for i := len(t.lines) - n; i < len(t.lines); i++ {
+		lines = append(lines, t.lines[(t.next+i)%len(t.lines)])
+	}
+	return lines
+}
+
+var (
+	// inputTail, mapTails and reduceTails hold the stderr tail of the input command and of every
+	// mapper and reducer.
+	inputTail   *stderrTail
+	mapTails    []*stderrTail
+	reduceTails []*stderrTail
+)
+
+// setupWorkerLogs creates the --worker-logs directory and allocates the stderr tails.
+func setupWorkerLogs() error {
+	if hasWorkerLogs() {
+		if err := os.MkdirAll(workerLogs, 0755); err != nil {
+			return err
+		}
+	}
+	inputTail = newStderrTail(stderrTailLines)
+	mapTails = make([]*stderrTail, mappers)
+	for i := range mapTails {
+		mapTails[i] = newStderrTail(stderrTailLines)
+	}
+	if hasReducer() {
+		reduceTails = make([]*stderrTail, reducers)
+		for i := range reduceTails {
+			reduceTails[i] = newStderrTail(stderrTailLines)
+		}
+	}
+	return nil
+}
+
+// tail returns the stderr tail of the worker.
+func (c context) tail() *stderrTail {
+	switch c.stage {
+	case stageInput:
+		return inputTail
+	case stageReduce:
+		return reduceTails[c.workerID]
+	}
+	return mapTails[c.workerID]
+}
+
+// workerLogPath returns the --worker-logs file of the worker, for example logs/map-3.log.
+func (c context) workerLogPath() string {
+	return path.Join(workerLogs, fmt.Sprintf("%s-%d.log", c.stage, c.workerID))
+}
+
+// withStderr adds the stderr tail of the worker to err.
+func (c context) withStderr(err error) error {
+	lines := c.tail().last()
+	if len(lines) == 0 {
+		return err
+	}
+	return fmt.Errorf("%v\nlast %d lines of stderr:\n  %s", err, len(lines), strings.Join(lines, "\n  "))
+}
+
+// workerLog is an open --worker-logs file. Writes and close are guarded by mu so that rollback can
+// flush and close the logs of workers that are still running.
+type workerLog struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+var (
+	workerLogsMu   sync.Mutex
+	openWorkerLogs = make(map[*workerLog]bool)
+)
+
+func openWorkerLog(filename string) (*workerLog, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	l := &workerLog{f: f, w: bufio.NewWriter(f)}
+	workerLogsMu.Lock()
+	openWorkerLogs[l] = true
+	workerLogsMu.Unlock()
+	return l, nil
+}
+
+// writeLine writes a line to the log, lines written after the log was closed are dropped.
+func (l *workerLog) writeLine(line string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	_, err := fmt.Fprintln(l.w, line)
+	return err
+}
+
+// close flushes and closes the log, closing it again does nothing.
+func (l *workerLog) close() error {
+	workerLogsMu.Lock()
+	delete(openWorkerLogs, l)
+	workerLogsMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// closeWorkerLogs flushes and closes the logs of all running workers, it is called on rollback so
+// that the logs are complete up to the point the job failed.
+func closeWorkerLogs() {
+	workerLogsMu.Lock()
+	logs := []*workerLog{}
+	for l := range openWorkerLogs {
+		logs = append(logs, l)
+	}
+	workerLogsMu.Unlock()
+	for _, l := range logs {
+		l.close()
+	}
+}
+
+// logStream handles the stderr of a worker. Counter and status reports are handled by report, all
+// other lines are kept in the stderr tail and either logged or, with --worker-logs, written to the
+// worker log file in which case only the tail is logged once the worker closes stderr.
+func logStream(c context, r io.ReadCloser) error {
+	var wl *workerLog
+	if hasWorkerLogs() {
+		var err error
+		if wl, err = openWorkerLog(c.workerLogPath()); err != nil {
+			return c.err(fmt.Sprintf("failed creating worker log - %v", err))
+		}
+		// only closes the log when returning early, close does nothing once it is closed
+		defer wl.close()
+	}
+	t := c.tail()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if report(c, line) {
+			continue
+		}
+		t.add(line)
+		if wl == nil {
+			c.logEvent(stderrLevel(line), "stderr", line)
+		} else if err := wl.writeLine(line); err != nil {
+			return c.err(fmt.Sprintf("failed writing worker log - %v", err))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if wl == nil {
+		return nil
+	}
+	if err := wl.close(); err != nil {
+		return c.err(fmt.Sprintf("failed writing worker log - %v", err))
+	}
+	if t.total > 0 {
+		c.logf("%d lines of stderr written to %s", t.total, c.workerLogPath())
+		for _, line := range t.last() {
+			c.logEvent(stderrLevel(line), "stderr", line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+var stderrTailTests = []struct {
+	size  int
+	lines int
+	want  []string
+}{
+	{0, 3, []string{}},
+	{3, 0, []string{}},
+	{3, 2, []string{"0", "1"}},
+	{3, 3, []string{"0", "1", "2"}},
+	{3, 7, []string{"4", "5", "6"}},
+}
+
+func TestStderrTail(t *testing.T) {
+	for _, tt := range stderrTailTests {
+		tail := newStderrTail(tt.size)
+		for i := 0; i < tt.lines; i++ {
+			tail.add(strconv.Itoa(i))
+		}
+		if got := tail.last(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tail of %d lines with size %d => %v, want %v", tt.lines, tt.size, got, tt.want)
+		}
+	}
+}